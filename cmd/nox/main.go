@@ -3,8 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"filippo.io/age"
 	"github.com/aottr/nox/internal/config"
 	"github.com/aottr/nox/internal/constants"
 	"github.com/aottr/nox/internal/crypto"
@@ -12,6 +18,7 @@ import (
 	"github.com/aottr/nox/internal/processor"
 	"github.com/aottr/nox/internal/watcher"
 	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
 )
 
 func main() {
@@ -23,12 +30,110 @@ func main() {
 	var configPath string
 	var statePath string
 	var identityPaths []string
+	var passphraseFile string
 
 	var dryRun bool
 	var force bool
 	var verbose bool
 	var inputPath string
 	var outputPath string
+	var summaryPath string
+	var waitFor time.Duration
+
+	oneshotFlags := []cli.Flag{
+		&cli.DurationFlag{
+			Name:        "wait-for",
+			Usage:       "retry until the repositories are reachable or the timeout expires",
+			Destination: &waitFor,
+		},
+		&cli.StringFlag{
+			Name:        "summary",
+			Usage:       "path to write the JSON summary to",
+			Value:       constants.StandardOutput,
+			Destination: &summaryPath,
+		},
+	}
+
+	envKeyFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "repo",
+			Usage: "path to a local working copy of the secrets repository",
+			Value: ".",
+		},
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "repository path of the app file, required if the app has several files",
+		},
+	}
+	envKeyWriteFlags := append(slices.Clone(envKeyFlags),
+		&cli.BoolFlag{
+			Name:  "commit",
+			Usage: "commit the re-encrypted file",
+		},
+		&cli.StringFlag{
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "commit message",
+		},
+	)
+
+	// envKeyContext builds the runtime context and options of the get, set and unset commands
+	envKeyContext := func(cmd *cli.Command) (*config.RuntimeContext, processor.EnvKeyOptions, error) {
+		opts := processor.EnvKeyOptions{
+			RepoDir: cmd.String("repo"),
+			File:    cmd.String("file"),
+			Commit:  cmd.Bool("commit"),
+			Message: cmd.String("message"),
+		}
+		if cmd.Args().Len() != 2 {
+			return nil, opts, fmt.Errorf("expected 2 arguments, usage: nox %s %s", cmd.Name, cmd.ArgsUsage)
+		}
+		rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+			ConfigPath:     configPath,
+			StatePath:      statePath,
+			IdentityPaths:  identityPaths,
+			PassphraseFile: passphraseFile,
+			AppName:        cmd.Args().First(),
+			Verbose:        verbose,
+		})
+		if err != nil {
+			return nil, opts, fmt.Errorf("failed to build runtime context: %w", err)
+		}
+		return rtx, opts, nil
+	}
+
+	// runOnce syncs all or one app a single time and exits with a code describing the outcome
+	runOnce := func(ctx context.Context, cmd *cli.Command) error {
+		// keep STDOUT for the JSON summary
+		logging.SetOutput(os.Stderr)
+		var summary *processor.Summary
+		rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+			ConfigPath:     configPath,
+			StatePath:      statePath,
+			IdentityPaths:  identityPaths,
+			PassphraseFile: passphraseFile,
+			Force:          force,
+			AppName:        cmd.String("app"),
+			Verbose:        verbose,
+		})
+		if err != nil {
+			summary = processor.ConfigFailure(err)
+		} else if waitFor > 0 {
+			if err := processor.WaitForRepos(rtx, waitFor); err != nil {
+				summary = processor.WaitFailure(err)
+			}
+		}
+		if summary == nil {
+			summary = processor.RunOnce(rtx)
+		}
+		if err := summary.Write(summaryPath); err != nil {
+			return err
+		}
+		if summary.ExitCode != constants.ExitOK {
+			return cli.Exit("", summary.ExitCode)
+		}
+		return nil
+	}
 
 	cmd := &cli.Command{
 		Name:                  "nox",
@@ -39,20 +144,25 @@ func main() {
 				Name:        "config",
 				Aliases:     []string{"c"},
 				Value:       constants.DefaultConfigPath,
-				Usage:       "path to config file",
+				Usage:       "path to config file, searched in the parent directories, $XDG_CONFIG_HOME/nox and /etc/nox if not set",
+				Sources:     cli.EnvVars(config.ConfigEnv),
 				Destination: &configPath,
 			},
 			&cli.StringFlag{
 				Name:        "state",
-				Value:       constants.DefaultStatePath,
-				Usage:       "path to state file",
+				Usage:       "path to state file (default: statePath of the config or " + constants.DefaultStatePath + ")",
 				Destination: &statePath,
 			},
 			&cli.StringSliceFlag{
 				Name:        "identity",
-				Usage:       "path to age identity file",
+				Usage:       "age identity or OpenSSH private key file, env:VAR, fd:N or - for STDIN",
 				Destination: &identityPaths,
 			},
+			&cli.StringFlag{
+				Name:        "passphrase-file",
+				Usage:       "path to a file holding the passphrase of encrypted identity files",
+				Destination: &passphraseFile,
+			},
 			&cli.BoolFlag{
 				Name:        "verbose",
 				Aliases:     []string{"v"},
@@ -60,6 +170,23 @@ func main() {
 				Usage:       "print verbose output",
 				Destination: &verbose,
 			},
+			&cli.StringFlag{
+				Name:    "env",
+				Aliases: []string{"e"},
+				Usage:   "environment of the config to apply",
+				Sources: cli.EnvVars(config.EnvironmentEnv),
+			},
+		},
+		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+			if verbose {
+				logging.SetLevel("debug")
+			}
+			config.SetEnvironment(cmd.String("env"))
+			if !cmd.IsSet("config") {
+				configPath = config.Discover()
+				log.Debug(fmt.Sprintf("using config %s", configPath))
+			}
+			return ctx, nil
 		},
 		Commands: []*cli.Command{
 			{
@@ -83,18 +210,101 @@ func main() {
 					},
 					&cli.StringSliceFlag{
 						Name:    "recipient",
-						Usage:   "age public key of recipient (repeatable)",
+						Usage:   "age or SSH public key of recipient (repeatable)",
 						Aliases: []string{"r"},
 					},
+					&cli.StringFlag{
+						Name:    "app",
+						Aliases: []string{"a"},
+						Usage:   "encrypt to the recipients configured for this app",
+					},
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "repository path of the app file whose recipients to use",
+					},
+					&cli.BoolFlag{
+						Name:    "passphrase",
+						Aliases: []string{"p"},
+						Usage:   "encrypt with a passphrase instead of recipients",
+					},
+					&cli.BoolFlag{
+						Name:  "armor",
+						Usage: "write ASCII armored (PEM-style) output",
+					},
+					&cli.BoolFlag{
+						Name:  "structured",
+						Usage: "encrypt each value of a dotenv, YAML or JSON file individually",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "structured format (dotenv, yaml, json), derived from the input file name by default",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					recipients, err := crypto.StringsToRecipients(cmd.StringSlice("recipient"))
-					if err != nil {
+					keys := cmd.StringSlice("recipient")
+					if appName := cmd.String("app"); appName != "" {
+						cfg, err := config.Load(configPath)
+						if err != nil {
+							return err
+						}
+						app, ok := cfg.Apps[appName]
+						if !ok {
+							return fmt.Errorf("app '%s' not found in configuration", appName)
+						}
+						var file *config.FileConfig
+						if path := cmd.String("file"); path != "" {
+							if file, ok = app.FindFile(path); !ok {
+								return fmt.Errorf("file '%s' not found in app '%s'", path, appName)
+							}
+						}
+						appKeys, err := cfg.RecipientsFor(appName, file)
+						if err != nil {
+							return err
+						}
+						keys = append(keys, appKeys...)
+					}
+					var recipients []age.Recipient
+					var err error
+					if cmd.Bool("passphrase") {
+						if len(keys) > 0 {
+							return fmt.Errorf("--passphrase cannot be combined with recipients")
+						}
+						r, err := crypto.PassphraseRecipient()
+						if err != nil {
+							return err
+						}
+						recipients = []age.Recipient{r}
+					} else if recipients, err = crypto.StringsToRecipients(keys); err != nil {
 						return err
 					}
-					if err := processor.IOWrapper(inputPath, outputPath, recipients, crypto.EncryptBytes); err != nil {
+					if cmd.Bool("structured") {
+						if cmd.Bool("armor") {
+							return fmt.Errorf("--armor cannot be combined with --structured")
+						}
+						var format crypto.Format
+						if cmd.String("format") != "" {
+							format, err = crypto.ParseFormat(cmd.String("format"))
+						} else {
+							format, err = crypto.FormatFromPath(inputPath)
+						}
+						if err != nil {
+							return err
+						}
+						// structured documents are parsed as a whole
+						err = processor.IOWrapper(inputPath, outputPath, recipients, func(data []byte, r []age.Recipient) ([]byte, error) {
+							return crypto.EncryptStructured(data, format, r)
+						})
+					} else {
+						err = processor.StreamWrapper(inputPath, outputPath, func(dst io.Writer, src io.Reader) error {
+							return crypto.EncryptStream(dst, src, recipients, cmd.Bool("armor"))
+						})
+					}
+					if err != nil {
 						return err
 					}
+					if outputPath != constants.StandardOutput && len(keys) > 0 {
+						return crypto.WriteRecipientsManifest(outputPath, keys)
+					}
 					return nil
 				},
 			},
@@ -119,11 +329,21 @@ func main() {
 					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
+					if inputPath == constants.StandardInput && slices.Contains(identityPaths, "-") {
+						return fmt.Errorf("cannot read both the identity and the input from stdin")
+					}
+					if passphraseFile != "" {
+						crypto.SetPassphraseFile(passphraseFile)
+					}
 					identities, err := crypto.LoadAgeIdentitiesFromPaths(identityPaths)
 					if err != nil {
 						return err
 					}
-					return processor.IOWrapper(inputPath, constants.StandardOutput, identities, crypto.DecryptBytes)
+					// files encrypted with a passphrase ask for it when decrypted
+					identities = append(identities, crypto.PassphraseIdentity())
+					return processor.StreamWrapper(inputPath, outputPath, func(dst io.Writer, src io.Reader) error {
+						return crypto.DecryptStreamAuto(dst, src, identities)
+					})
 				},
 			},
 			{
@@ -136,32 +356,139 @@ func main() {
 						Value:       constants.StandardOutput,
 						Destination: &outputPath,
 					},
+					&cli.BoolFlag{
+						Name:  "add-recipient",
+						Usage: "append the new public key to the recipients of the config file",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
+					var pub string
 					output := cmd.String("output")
 					switch output {
 					case constants.StandardOutput:
-						priv, pub, err := crypto.GenerateIdentity("")
+						priv, p, err := crypto.GenerateIdentity("")
 						if err != nil {
 							return err
 						}
+						pub = p
 						fmt.Println("Public key:\n", pub, "\nPrivate Key:\n", priv)
 					default:
-						_, _, err := crypto.GenerateIdentity(cmd.String("output"))
+						_, p, err := crypto.GenerateIdentity(cmd.String("output"))
 						if err != nil {
 							return err
 						}
+						pub = p
 					}
 
+					if cmd.Bool("add-recipient") {
+						if err := config.AppendRecipient(configPath, pub); err != nil {
+							return fmt.Errorf("failed to add recipient to %s: %w", configPath, err)
+						}
+						log.Info(fmt.Sprintf("added %s to the recipients in %s", pub, configPath))
+					}
 					return nil
 				},
 			},
+			{
+				Name:  "keys",
+				Usage: "Inspect identities and public keys",
+				Commands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List the identities loaded from the config or --identity with their public keys",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							sources := identityPaths
+							if len(sources) == 0 {
+								cfg, err := config.Load(configPath)
+								if err != nil {
+									return err
+								}
+								sources = cfg.IdentitySources()
+							}
+							if len(sources) == 0 {
+								return fmt.Errorf("no age identites found")
+							}
+							infos, err := crypto.LoadIdentityInfosFromPaths(sources)
+							if err != nil {
+								return err
+							}
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "TYPE\tRECIPIENT\tSOURCE")
+							for _, info := range infos {
+								recipient := info.Recipient
+								if recipient == "" {
+									recipient = "-"
+								}
+								fmt.Fprintf(w, "%s\t%s\t%s\n", info.Type, recipient, info.Source)
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:      "pub",
+						Usage:     "Print the public keys of an identity file",
+						ArgsUsage: "<identity-file>",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							path := cmd.Args().First()
+							if path == "" {
+								return fmt.Errorf("missing identity file")
+							}
+							infos, err := crypto.LoadIdentityInfos(path)
+							if err != nil {
+								return err
+							}
+							for _, info := range infos {
+								if info.Recipient == "" {
+									return fmt.Errorf("public key of %s identity is only known to its plugin", info.Type)
+								}
+								fmt.Println(info.Recipient)
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "fingerprint",
+						Usage:     "Print SHA256 fingerprints of recipients, or of the loaded identities",
+						ArgsUsage: "[recipient...]",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							recipients := cmd.Args().Slice()
+							if len(recipients) == 0 {
+								sources := identityPaths
+								if len(sources) == 0 {
+									cfg, err := config.Load(configPath)
+									if err != nil {
+										return err
+									}
+									sources = cfg.IdentitySources()
+								}
+								infos, err := crypto.LoadIdentityInfosFromPaths(sources)
+								if err != nil {
+									return err
+								}
+								for _, info := range infos {
+									if info.Recipient != "" {
+										recipients = append(recipients, info.Recipient)
+									}
+								}
+							}
+							for _, r := range recipients {
+								fp, err := crypto.Fingerprint(r)
+								if err != nil {
+									return err
+								}
+								fmt.Printf("%s %s\n", fp, r)
+							}
+							return nil
+						},
+					},
+				},
+			},
 			{
 				Name:    "sync",
 				Aliases: []string{"fetch"},
 				Usage:   "Fetches and decrypts all secrets of one or all apps",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "app",
 						Aliases: []string{"a"},
@@ -181,19 +508,27 @@ func main() {
 						Usage:       "ignore state file",
 						Destination: &force,
 					},
-				},
+					&cli.BoolFlag{
+						Name:  "oneshot",
+						Usage: "run once with strict exit codes and a JSON summary",
+					},
+				}, oneshotFlags...),
 				Action: func(ctx context.Context, cmd *cli.Command) error {
+					if cmd.Bool("oneshot") {
+						return runOnce(ctx, cmd)
+					}
 					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
-						ConfigPath:    configPath,
-						StatePath:     statePath,
-						IdentityPaths: identityPaths,
-						DryRun:        dryRun,
-						Force:         force,
-						AppName:       cmd.String("app"),
-						Verbose:       verbose,
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						DryRun:         dryRun,
+						Force:          force,
+						AppName:        cmd.String("app"),
+						Verbose:        verbose,
 					})
 					if err != nil {
-						log.Error("failed to build runtime context", "error", err.Error())
+						return fmt.Errorf("failed to build runtime context: %w", err)
 					}
 					if cmd.String("app") != "" {
 						return processor.SyncApp(rtx)
@@ -201,33 +536,594 @@ func main() {
 					return processor.SyncApps(rtx)
 				},
 			},
+			{
+				Name:    "run-once",
+				Aliases: []string{"oneshot"},
+				Usage:   "Sync secrets once with strict exit codes, for init containers and cron",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "app",
+						Aliases: []string{"a"},
+						Usage:   "app to decrypt secrets for",
+					},
+					&cli.BoolFlag{
+						Name:        "force",
+						Aliases:     []string{"f"},
+						Value:       false,
+						Usage:       "ignore state file",
+						Destination: &force,
+					},
+				}, oneshotFlags...),
+				Action: runOnce,
+			},
+			{
+				Name:  "rekey",
+				Usage: "Re-encrypt all secrets in a working copy of the repository to the configured recipients",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "repo",
+						Usage: "path to a local working copy of the secrets repository (default: .), repeat as <repo url>=<path> for apps with a repository of their own",
+					},
+					&cli.StringFlag{
+						Name:    "app",
+						Aliases: []string{"a"},
+						Usage:   "only re-encrypt the files of this app",
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "re-encrypt all .age files below this directory of the repository instead of the configured files",
+					},
+					&cli.BoolFlag{
+						Name:        "dry-run",
+						Aliases:     []string{"d"},
+						Value:       false,
+						Usage:       "only list the files that would be re-encrypted",
+						Destination: &dryRun,
+					},
+					&cli.BoolFlag{
+						Name:  "commit",
+						Usage: "commit the re-encrypted files",
+					},
+					&cli.StringFlag{
+						Name:    "message",
+						Aliases: []string{"m"},
+						Usage:   "commit message",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						AppName:        cmd.String("app"),
+						Verbose:        verbose,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to build runtime context: %w", err)
+					}
+					opts := processor.RekeyOptions{
+						RepoDir:  ".",
+						RepoDirs: make(map[string]string),
+						Dir:      cmd.String("dir"),
+						DryRun:   dryRun,
+						Commit:   cmd.Bool("commit"),
+						Message:  cmd.String("message"),
+					}
+					// a working copy of an app repository is given as <repo url>=<path>
+					for _, repo := range cmd.StringSlice("repo") {
+						if i := strings.LastIndex(repo, "="); i >= 0 {
+							opts.RepoDirs[repo[:i]] = repo[i+1:]
+						} else {
+							opts.RepoDir = repo
+						}
+					}
+					_, err = processor.Rekey(rtx, opts)
+					return err
+				},
+			},
+			{
+				Name:      "add",
+				Usage:     "Encrypt a secret into a working copy of the repository and register it for an app",
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "app",
+						Aliases:  []string{"a"},
+						Usage:    "app to register the secret for",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "path the secret is decrypted to when syncing",
+					},
+					&cli.StringFlag{
+						Name:  "repo",
+						Usage: "path to a local working copy of the secrets repository",
+						Value: ".",
+					},
+					&cli.StringFlag{
+						Name:  "path",
+						Usage: "path of the encrypted file in the repository (default: <file>.age)",
+					},
+					&cli.BoolFlag{
+						Name:  "structured",
+						Usage: "only encrypt the values of a dotenv, YAML or JSON file",
+					},
+					&cli.BoolFlag{
+						Name:  "commit",
+						Usage: "commit the encrypted file",
+					},
+					&cli.BoolFlag{
+						Name:  "push",
+						Usage: "commit the encrypted file and push it to origin",
+					},
+					&cli.StringFlag{
+						Name:    "message",
+						Aliases: []string{"m"},
+						Usage:   "commit message",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					input := cmd.Args().First()
+					if input == "" {
+						return fmt.Errorf("missing file to add")
+					}
+					cfg, err := config.Load(configPath)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+					return processor.AddSecret(cfg, processor.AddOptions{
+						ConfigPath: configPath,
+						App:        cmd.String("app"),
+						Input:      input,
+						RepoDir:    cmd.String("repo"),
+						RepoPath:   cmd.String("path"),
+						Output:     cmd.String("output"),
+						Structured: cmd.Bool("structured"),
+						Commit:     cmd.Bool("commit"),
+						Push:       cmd.Bool("push"),
+						Message:    cmd.String("message"),
+					})
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "Print the value of a key of an app's dotenv secret",
+				ArgsUsage: "<app> <KEY>",
+				Flags:     envKeyFlags,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					rtx, opts, err := envKeyContext(cmd)
+					if err != nil {
+						return err
+					}
+					value, err := processor.GetEnvKey(rtx, opts, cmd.Args().Get(1))
+					if err != nil {
+						return err
+					}
+					fmt.Println(value)
+					return nil
+				},
+			},
+			{
+				Name:      "set",
+				Usage:     "Set a key of an app's dotenv secret and re-encrypt it",
+				ArgsUsage: "<app> <KEY>=<VALUE>",
+				Flags:     envKeyWriteFlags,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					rtx, opts, err := envKeyContext(cmd)
+					if err != nil {
+						return err
+					}
+					key, value, ok := strings.Cut(cmd.Args().Get(1), "=")
+					if !ok {
+						return fmt.Errorf("expected <KEY>=<VALUE>, got %q", cmd.Args().Get(1))
+					}
+					return processor.SetEnvKey(rtx, opts, key, value)
+				},
+			},
+			{
+				Name:      "unset",
+				Usage:     "Remove a key from an app's dotenv secret and re-encrypt it",
+				ArgsUsage: "<app> <KEY>",
+				Flags:     envKeyWriteFlags,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					rtx, opts, err := envKeyContext(cmd)
+					if err != nil {
+						return err
+					}
+					return processor.UnsetEnvKey(rtx, opts, cmd.Args().Get(1))
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "Show which keys of a secret changed between two revisions of the repository",
+				ArgsUsage: "<file> [rev1] [rev2]",
+				Description: "Compares rev1 (default HEAD~1) with rev2 (default HEAD). Values are masked unless --show-values is set.\n" +
+					"With --textconv the decrypted local <file> is printed for the textconv option of git diff.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "app",
+						Aliases: []string{"a"},
+						Usage:   "use the repository of this app instead of the global one",
+					},
+					&cli.BoolFlag{
+						Name:  "show-values",
+						Usage: "print the secret values instead of masking them",
+					},
+					&cli.BoolFlag{
+						Name:  "textconv",
+						Usage: "print the decrypted local file for git diff",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					args := cmd.Args()
+					path := args.First()
+					if path == "" || args.Len() > 3 {
+						return fmt.Errorf("usage: nox diff %s", cmd.ArgsUsage)
+					}
+
+					if cmd.Bool("textconv") {
+						// git runs textconv anywhere in the repository, the config is only needed without --identity
+						paths := identityPaths
+						if len(paths) == 0 {
+							if cfg, err := config.Load(configPath); err == nil {
+								paths = cfg.IdentitySources()
+							}
+						}
+						identities, err := crypto.LoadAgeIdentitiesFromPaths(paths)
+						if err != nil {
+							return err
+						}
+						data, err := os.ReadFile(path)
+						if err != nil {
+							return err
+						}
+						return processor.Textconv(data, path, identities, cmd.Bool("show-values"), os.Stdout)
+					}
+
+					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						AppName:        cmd.String("app"),
+						Verbose:        verbose,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to build runtime context: %w", err)
+					}
+					opts := processor.DiffOptions{Path: path, From: "HEAD~1", To: "HEAD", ShowValues: cmd.Bool("show-values")}
+					if args.Len() > 1 {
+						opts.From = args.Get(1)
+					}
+					if args.Len() > 2 {
+						opts.To = args.Get(2)
+					}
+					return processor.DiffSecret(rtx, opts, os.Stdout)
+				},
+			},
+			{
+				Name:      "history",
+				Usage:     "List the commits that changed the secrets of an app",
+				ArgsUsage: "<app> [file]",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					appName := cmd.Args().First()
+					if appName == "" {
+						return fmt.Errorf("usage: nox history %s", cmd.ArgsUsage)
+					}
+					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						AppName:        appName,
+						Verbose:        verbose,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to build runtime context: %w", err)
+					}
+					return processor.History(rtx, cmd.Args().Get(1), os.Stdout)
+				},
+			},
+			{
+				Name:      "rollback",
+				Usage:     "Sync an app from an earlier commit and pin it there until released",
+				ArgsUsage: "<app>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "commit, tag or revision like HEAD~1 to roll back to",
+					},
+					&cli.BoolFlag{
+						Name:  "release",
+						Usage: "remove the pin and sync the app from the branch head again",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					appName := cmd.Args().First()
+					if appName == "" {
+						return fmt.Errorf("usage: nox rollback %s --to <commit>", cmd.ArgsUsage)
+					}
+					if (cmd.String("to") == "") == !cmd.Bool("release") {
+						return fmt.Errorf("either --to or --release is required")
+					}
+					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						AppName:        appName,
+						Verbose:        verbose,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to build runtime context: %w", err)
+					}
+					if cmd.Bool("release") {
+						return processor.Release(rtx)
+					}
+					return processor.Rollback(rtx, cmd.String("to"))
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore a previous output of an app file from its local backups",
+				ArgsUsage: "<app> <file>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "version",
+						Usage: "backup to restore, 1 is the most recent",
+						Value: 1,
+					},
+					&cli.BoolFlag{
+						Name:  "list",
+						Usage: "list the available backups instead of restoring one",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					if cmd.Args().Len() != 2 {
+						return fmt.Errorf("usage: nox restore %s", cmd.ArgsUsage)
+					}
+					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						AppName:        cmd.Args().First(),
+						Verbose:        verbose,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to build runtime context: %w", err)
+					}
+					if cmd.Bool("list") {
+						return processor.ListBackups(rtx, cmd.Args().Get(1), os.Stdout)
+					}
+					return processor.RestoreBackup(rtx, cmd.Args().Get(1), int(cmd.Int("version")))
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Show which recipients an encrypted file is encrypted to, without decrypting it",
+				ArgsUsage: "<file.age>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "app",
+						Aliases: []string{"a"},
+						Usage:   "compare with the recipients configured for this app",
+					},
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "repository path of the app file whose recipients to compare with",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					path := cmd.Args().First()
+					if path == "" {
+						return fmt.Errorf("missing file to inspect")
+					}
+					data, err := os.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					header, err := crypto.ParseHeader(data)
+					if err != nil {
+						return err
+					}
+					var manifest []string
+					if data, err := os.ReadFile(crypto.ManifestPath(path)); err == nil {
+						manifest = crypto.ParseRecipientsManifest(data)
+					}
+
+					// the config is optional, it only names known keys
+					cfg, cfgErr := config.Load(configPath)
+					var known []string
+					if cfgErr == nil {
+						known = cfg.AllRecipients()
+					}
+					processor.PrintHeader(header, known)
+					for _, r := range manifest {
+						fmt.Printf("  manifest: %s\n", r)
+					}
+
+					appName := cmd.String("app")
+					if appName == "" {
+						return nil
+					}
+					if cfgErr != nil {
+						return cfgErr
+					}
+					app, ok := cfg.Apps[appName]
+					if !ok {
+						return fmt.Errorf("app '%s' not found in configuration", appName)
+					}
+					var file *config.FileConfig
+					if filePath := cmd.String("file"); filePath != "" {
+						if file, ok = app.FindFile(filePath); !ok {
+							return fmt.Errorf("file '%s' not found in app '%s'", filePath, appName)
+						}
+					}
+					expected, err := cfg.RecipientsFor(appName, file)
+					if err != nil {
+						return err
+					}
+					problems := processor.AuditRecipients(header, manifest, expected)
+					for _, p := range problems {
+						fmt.Printf("⚠️ %s\n", p)
+					}
+					if len(problems) > 0 {
+						return fmt.Errorf("recipients of %s do not match app %s", path, appName)
+					}
+					fmt.Printf("✔️ recipients match app %s\n", appName)
+					return nil
+				},
+			},
 			{
 				Name:    "validate",
 				Aliases: []string{"v"},
 				Usage:   "Validate configuration and secret integrity",
 				Action: func(ctx context.Context, cmd *cli.Command) error {
+					// report every problem of the config file at once, identities given
+					// on the command line replace the configured ones
+					check := config.Check
+					if len(identityPaths) > 0 {
+						check = config.Load
+					}
+					if _, err := check(configPath); err != nil {
+						return err
+					}
 					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
-						ConfigPath:    configPath,
-						StatePath:     statePath,
-						IdentityPaths: identityPaths,
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
 					})
 					if err != nil {
-						log.Error("failed to build runtime context", "error", err.Error())
+						return fmt.Errorf("failed to build runtime context: %w", err)
 					}
 					return processor.ValidateConfig(rtx.Config)
 				},
 			},
 			{
-				Name: "init",
+				Name:  "doctor",
+				Usage: "Check step by step everything a sync depends on",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return processor.Doctor(processor.DoctorOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+					}, os.Stdout)
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect the configuration and its format",
+				Commands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Print the effective config with includes, templates and the environment applied",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "app",
+								Aliases: []string{"a"},
+								Usage:   "only print this app",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							cfg, err := config.Load(configPath)
+							if err != nil {
+								return err
+							}
+							var out any = cfg.Effective()
+							if appName := cmd.String("app"); appName != "" {
+								app, ok := cfg.Apps[appName]
+								if !ok {
+									return fmt.Errorf("app '%s' not found in configuration", appName)
+								}
+								out = map[string]any{"apps": map[string]config.AppConfig{appName: app}}
+							}
+							data, err := cfg.MarshalUnexpanded(out)
+							if err != nil {
+								return err
+							}
+							fmt.Print(string(data))
+							return nil
+						},
+					},
+					{
+						Name:  "schema",
+						Usage: "Print the JSON Schema of the config file for editor validation and autocompletion",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							schema, err := config.Schema()
+							if err != nil {
+								return err
+							}
+							fmt.Println(string(schema))
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "init",
+				Usage: "Create a config, asking for the repository, identity and apps unless --non-interactive is set",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "repo",
+						Usage: "URL of the secrets repository",
+					},
+					&cli.StringFlag{
+						Name:  "branch",
+						Usage: "branch of the secrets repository",
+						Value: "main",
+					},
+					&cli.StringFlag{
+						Name:  "key",
+						Usage: "age identity file, generated if it does not exist",
+						Value: "keys/key.txt",
+					},
+					&cli.BoolFlag{
+						Name:  "discover",
+						Usage: "create apps for the .age files of the repository",
+					},
+					&cli.BoolFlag{
+						Name:  "non-interactive",
+						Usage: "do not prompt, take every setting from the flags",
+					},
+				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					return config.InitConfig(configPath)
+					// a config found in a parent directory is not the one to create
+					path := configPath
+					if !cmd.Root().IsSet("config") {
+						path = constants.DefaultConfigPath
+					}
+					return processor.Init(processor.InitOptions{
+						ConfigPath:  path,
+						Repo:        cmd.String("repo"),
+						Branch:      cmd.String("branch"),
+						Identity:    cmd.String("key"),
+						Discover:    cmd.Bool("discover"),
+						Interactive: !cmd.Bool("non-interactive") && term.IsTerminal(int(os.Stdin.Fd())),
+						In:          os.Stdin,
+						Out:         os.Stdout,
+					})
 				},
 			},
 			{
 				Name: "watch",
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					cfg, _ := config.Load(configPath)
-					watcher.Start(cfg)
+					rtx, err := config.BuildRuntimeContext(config.RuntimeOptions{
+						ConfigPath:     configPath,
+						StatePath:      statePath,
+						IdentityPaths:  identityPaths,
+						PassphraseFile: passphraseFile,
+						Verbose:        verbose,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to build runtime context: %w", err)
+					}
+					watcher.Start(rtx)
 					return nil
 				},
 			},
@@ -236,5 +1132,6 @@ func main() {
 
 	if err := cmd.Run(context.Background(), os.Args); err != nil {
 		log.Error("failed to run command", "error", err.Error())
+		os.Exit(constants.ExitFailure)
 	}
 }
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -14,8 +16,21 @@ type SecretMapping struct {
 }
 
 type FileConfig struct {
-	Path   string `yaml:"path"`
-	Output string `yaml:"output,omitempty"`
+	Path       string   `yaml:"path"`
+	Output     string   `yaml:"output,omitempty"`
+	Recipients []string `yaml:"recipients,omitempty"`
+}
+
+// OutputPath returns the output of the file, by default the base name with .age replaced by .env
+func (f FileConfig) OutputPath() string {
+	path := f.Output
+	if path == "" {
+		path = filepath.Base(f.Path)
+		if filepath.Ext(path) == ".age" {
+			path = path[:len(path)-4] + ".env"
+		}
+	}
+	return path
 }
 
 type GitConfig struct {
@@ -27,15 +42,28 @@ func (g GitConfig) IsValid() bool {
 	return g.Repo != "" && g.Branch != ""
 }
 
+// BackupConfig keeps the last Keep outputs of every file of an app, encrypted to
+// Recipients or, if unset, to the X25519 identities nox decrypts with
+type BackupConfig struct {
+	Keep       int      `yaml:"keep"`
+	Dir        string   `yaml:"dir,omitempty"`
+	Recipients []string `yaml:"recipients,omitempty"`
+}
+
 type AppConfig struct {
-	GitConfig GitConfig    `yaml:"git,omitempty"`
-	Files     []FileConfig `yaml:"files"`
+	GitConfig  GitConfig     `yaml:"git,omitempty"`
+	Files      []FileConfig  `yaml:"files"`
+	Recipients []string      `yaml:"recipients,omitempty"`
+	Backup     *BackupConfig `yaml:"backup,omitempty"`
+	Extends    Extends       `yaml:"extends,omitempty"`
 }
 
 type AgeConfig struct {
-	Identity   string   `yaml:"identity"`
-	Identities []string `yaml:"identities,omitempty"`
-	Recipients []string `yaml:"recipients,omitempty"`
+	Identity       string              `yaml:"identity"`
+	Identities     []string            `yaml:"identities,omitempty"`
+	PassphraseFile string              `yaml:"passphraseFile,omitempty"`
+	Recipients     []string            `yaml:"recipients,omitempty"`
+	Groups         map[string][]string `yaml:"groups,omitempty"`
 }
 
 type Config struct {
@@ -43,62 +71,68 @@ type Config struct {
 	IntervalString string               `yaml:"interval"`
 	Age            AgeConfig            `yaml:"age"`
 	StatePath      string               `yaml:"statePath"`
-	GitConfig      GitConfig            `yaml:"git"`
+	GitConfig      GitConfig            `yaml:"git,omitempty"`
 	Apps           map[string]AppConfig `yaml:"apps"`
+	// Include lists globs of files contributing apps and recipients, .nox.d/*.yaml is always included
+	Include []string `yaml:"include,omitempty"`
+	// Defaults are merged into every app, before the templates it extends
+	Defaults     *AppConfig             `yaml:"defaults,omitempty"`
+	Templates    map[string]AppConfig   `yaml:"templates,omitempty"`
+	Environments map[string]Environment `yaml:"environments,omitempty"`
+
+	// Environment is the name of the applied environment, empty if none
+	Environment string `yaml:"-"`
+
+	// appFiles maps every app to the config file defining it
+	appFiles map[string]string
+	// references maps the values expanded from ${VAR} and file: references to the text of the config
+	references map[string]string
 }
 
-func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
-	}
-
-	// validate config
-	// must have at least one git config
-	hasAnyGit := cfg.GitConfig.IsValid()
-	if !hasAnyGit {
-		for _, app := range cfg.Apps {
-			if app.GitConfig.IsValid() {
-				hasAnyGit = true
-				break
-			}
-		}
-	}
-	if !hasAnyGit {
-		return nil, fmt.Errorf("no git configuration found: set either top-level git or app-specific git")
-	}
+// AppFile returns the path of the config file that defines the app, empty if the app does not exist
+func (c *Config) AppFile(name string) string {
+	return c.appFiles[name]
+}
 
-	// validate interval
-	cfg.Interval, err = time.ParseDuration(cfg.IntervalString)
-	if err != nil {
-		return nil, fmt.Errorf("invalid interval: %w", err)
-	}
-	return &cfg, nil
+// Load reads the config file strictly, unknown keys and invalid values are
+// reported with their line and column in a *ValidationError
+func Load(path string) (*Config, error) {
+	return parse(path, false)
 }
 
-func InitConfig(path string) error {
+// InitConfig writes cfg to a new config file at path, it fails if the file exists. The config
+// is checked like Check in a temporary file next to path, an invalid config is never written.
+func InitConfig(path string, cfg Config) error {
 
 	_, err := os.Stat(path)
 	if err == nil {
 		return fmt.Errorf("config file already exists")
 	}
 
-	cfg := Config{
-		IntervalString: "10m",
-		StatePath:      ".nox-state.json",
-		GitConfig: GitConfig{
-			Repo:   "",
-			Branch: "main",
-		},
-	}
 	cfgYaml, err := yaml.Marshal(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
-	return os.WriteFile(path, cfgYaml, 0600)
+
+	// relative paths of the config resolve against the same directory as at path
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(cfgYaml); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if _, err := Check(tmp.Name()); err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			verr.Path = path
+		}
+		return fmt.Errorf("%s was not written: %w", path, err)
+	}
+	return os.Rename(tmp.Name(), path)
 }
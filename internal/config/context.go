@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"os"
 
 	"filippo.io/age"
 	"github.com/aottr/nox/internal/crypto"
@@ -9,13 +10,14 @@ import (
 )
 
 type RuntimeOptions struct {
-	ConfigPath    string
-	StatePath     string
-	IdentityPaths []string
-	DryRun        bool
-	Force         bool
-	Verbose       bool
-	AppName       string
+	ConfigPath     string
+	StatePath      string
+	IdentityPaths  []string
+	PassphraseFile string
+	DryRun         bool
+	Force          bool
+	Verbose        bool
+	AppName        string
 }
 
 type RuntimeContext struct {
@@ -23,41 +25,24 @@ type RuntimeContext struct {
 	State      *state.State
 	Identities []age.Identity
 	App        string
+	Env        string // applied environment of the config, empty if none
 	DryRun     bool
 	Force      bool
 }
 
-func BuildRuntimeCtxFromConfig(config *Config) (*RuntimeContext, error) {
-
-	if config.StatePath != "" {
-		state.SetPath(config.StatePath)
+// IdentitySources returns the configured identity files and sources. The single identity
+// takes precedence, without any configured identity NOX_AGE_KEY is used if set.
+func (c *Config) IdentitySources() []string {
+	if c.Age.Identity != "" {
+		return []string{c.Age.Identity}
 	}
-	st, err := state.Load()
-	if err != nil {
-		return nil, err
+	if len(c.Age.Identities) > 0 {
+		return c.Age.Identities
 	}
-
-	var identityPaths []string
-	// try single identity file first
-	if config.Age.Identity != "" {
-		identityPaths = []string{config.Age.Identity}
-	} else if len(config.Age.Identities) > 0 {
-		identityPaths = config.Age.Identities
-	} else {
-		return nil, fmt.Errorf("no age identites found")
+	if _, ok := os.LookupEnv(crypto.DefaultIdentityEnv); ok {
+		return []string{"env:" + crypto.DefaultIdentityEnv}
 	}
-	ids, err := crypto.LoadAgeIdentitiesFromPaths(identityPaths)
-	if err != nil {
-		return nil, err
-	}
-
-	return &RuntimeContext{
-		Config:     config,
-		State:      st,
-		Identities: ids,
-		DryRun:     false,
-		Force:      false,
-	}, nil
+	return nil
 }
 
 func BuildRuntimeContext(opts RuntimeOptions) (*RuntimeContext, error) {
@@ -69,22 +54,26 @@ func BuildRuntimeContext(opts RuntimeOptions) (*RuntimeContext, error) {
 
 	if opts.StatePath != "" {
 		state.SetPath(opts.StatePath)
+	} else if cfg.StatePath != "" {
+		state.SetPath(cfg.StatePath)
 	}
 	st, err := state.Load()
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.PassphraseFile != "" {
+		crypto.SetPassphraseFile(opts.PassphraseFile)
+	} else if cfg.Age.PassphraseFile != "" {
+		crypto.SetPassphraseFile(cfg.Age.PassphraseFile)
+	}
+
 	identityPaths := opts.IdentityPaths
 	if len(identityPaths) == 0 {
-		// try single identity file first
-		if cfg.Age.Identity != "" {
-			identityPaths = []string{cfg.Age.Identity}
-		} else if len(cfg.Age.Identities) > 0 {
-			identityPaths = cfg.Age.Identities
-		} else {
-			return nil, fmt.Errorf("no age identites found")
-		}
+		identityPaths = cfg.IdentitySources()
+	}
+	if len(identityPaths) == 0 {
+		return nil, fmt.Errorf("no age identites found")
 	}
 	ids, err := crypto.LoadAgeIdentitiesFromPaths(identityPaths)
 	if err != nil {
@@ -105,6 +94,7 @@ func BuildRuntimeContext(opts RuntimeOptions) (*RuntimeContext, error) {
 		State:      st,
 		Identities: ids,
 		App:        app,
+		Env:        cfg.Environment,
 		DryRun:     opts.DryRun,
 		Force:      opts.Force,
 	}, nil
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/aottr/nox/internal/constants"
+	"github.com/aottr/nox/internal/crypto"
+)
+
+// ConfigEnv names the config file, it takes precedence over the search paths
+const ConfigEnv = "NOX_CONFIG"
+
+// systemConfigPath is the last location searched for the config
+const systemConfigPath = "/etc/nox/config.yaml"
+
+// SearchPaths returns the locations searched for the config in order: the current directory,
+// its parents up to the root of the git repository, the user config directory and /etc/nox
+func SearchPaths() []string {
+	paths := []string{constants.DefaultConfigPath}
+
+	if cwd, err := os.Getwd(); err == nil {
+		var parents []string
+		for dir := cwd; ; {
+			if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+				// parents are only searched inside a git repository
+				paths = append(paths, parents...)
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+			parents = append(parents, filepath.Join(dir, constants.DefaultConfigPath))
+		}
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "nox", "config.yaml"))
+	}
+	return append(paths, systemConfigPath)
+}
+
+// Discover returns the first existing config of the search paths, the default path if none exists
+func Discover() string {
+	for _, path := range SearchPaths() {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return constants.DefaultConfigPath
+}
+
+// resolvePaths makes the relative paths of the config relative to the directory of the config
+// file instead of the working directory, so nox behaves the same when run from cron or systemd.
+// appDir returns the directory of the file setting a key of an app, like an included file.
+func (c *Config) resolvePaths(dir string, appDir func(app, key string) string) {
+	resolve := func(dir, path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	if c.StatePath == "" {
+		c.StatePath = constants.DefaultStatePath
+	}
+	c.StatePath = resolve(dir, c.StatePath)
+	// env:VAR, fd:N and - for STDIN are no files
+	if !crypto.IsIdentitySource(c.Age.Identity) {
+		c.Age.Identity = resolve(dir, c.Age.Identity)
+	}
+	for i, source := range c.Age.Identities {
+		if !crypto.IsIdentitySource(source) {
+			c.Age.Identities[i] = resolve(dir, source)
+		}
+	}
+	c.Age.PassphraseFile = resolve(dir, c.Age.PassphraseFile)
+
+	for name, app := range c.Apps {
+		files := make([]FileConfig, len(app.Files))
+		for i, file := range app.Files {
+			file.Output = resolve(appDir(name, "files"), file.OutputPath())
+			files[i] = file
+		}
+		app.Files = files
+		if app.Backup != nil {
+			backup := *app.Backup
+			if backup.Dir == "" {
+				backup.Dir = constants.DefaultBackupDir
+			}
+			backup.Dir = resolve(appDir(name, "backup"), backup.Dir)
+			app.Backup = &backup
+		}
+		c.Apps[name] = app
+	}
+}
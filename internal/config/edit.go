@@ -0,0 +1,307 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// appendItem appends item to the sequence found under the mapping keys of the YAML file at path,
+// adding the missing mappings and the sequence. Only the new text is spliced into the file, every
+// other byte stays as it is, so comments, blank lines and indentation are preserved. It returns
+// false without writing if exists reports an item of the sequence as already present.
+func appendItem(path string, keys []string, item *yaml.Node, exists func(*yaml.Node) bool) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	s := &splicer{data: data}
+	if len(doc.Content) == 0 {
+		err = s.addKey(nil, keys[0], nested(keys[1:], item))
+	} else {
+		err = s.appendAt(doc.Content[0], keys, item, exists)
+	}
+	if err != nil || s.data == nil {
+		return false, err
+	}
+	return true, os.WriteFile(path, s.data, info.Mode().Perm())
+}
+
+// nested builds the mappings of keys around a sequence holding item
+func nested(keys []string, item *yaml.Node) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{item}}
+	for i := len(keys) - 1; i >= 0; i-- {
+		node = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: keys[i]}, node,
+		}}
+	}
+	return node
+}
+
+// splicer inserts rendered YAML into the original text of a document at the positions of its nodes.
+// data is reset to nil if nothing was changed.
+type splicer struct {
+	data []byte
+}
+
+func (s *splicer) appendAt(root *yaml.Node, keys []string, item *yaml.Node, exists func(*yaml.Node) bool) error {
+	node := root
+	for i, key := range keys {
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s is not a mapping", strings.Join(keys[:i], "."))
+		}
+		keyNode, value := mappingEntry(node, key)
+		switch {
+		case value == nil:
+			return s.addKey(node, key, nested(keys[i+1:], item))
+		case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+			return s.fill(keyNode, value, nested(keys[i+1:], item))
+		}
+		node = value
+	}
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s is not a list", strings.Join(keys, "."))
+	}
+	for _, existing := range node.Content {
+		if exists(existing) {
+			s.data = nil
+			return nil
+		}
+	}
+	return s.appendToSequence(node, item)
+}
+
+// addKey adds key with value to the mapping m, nil for an empty document
+func (s *splicer) addKey(m *yaml.Node, key string, value *yaml.Node) error {
+	entry := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: key}, value}}
+	if m != nil && m.Style&yaml.FlowStyle != 0 {
+		return s.insertFlow(m, '{', '}', len(m.Content) > 0, entry)
+	}
+	text, err := render(entry)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		s.insert(len(s.data), text)
+		return nil
+	}
+	s.insert(s.lineStart(s.endLine(m)+1), indent(text, m.Column-1))
+	return nil
+}
+
+// fill replaces the empty or null value of keyNode with value
+func (s *splicer) fill(keyNode, null, value *yaml.Node) error {
+	text, err := render(value)
+	if err != nil {
+		return err
+	}
+	s.insert(s.lineStart(keyNode.Line+1), indent(text, keyNode.Column+1))
+	// an explicit null or ~ is removed, an empty value has no text
+	if null.Value != "" {
+		off := s.offset(null.Line, null.Column)
+		start := off
+		for start > 0 && (s.data[start-1] == ' ' || s.data[start-1] == '\t') {
+			start--
+		}
+		s.data = append(s.data[:start:start], s.data[off+len(null.Value):]...)
+	}
+	return nil
+}
+
+func (s *splicer) appendToSequence(seq, item *yaml.Node) error {
+	if seq.Style&yaml.FlowStyle != 0 {
+		return s.insertFlow(seq, '[', ']', len(seq.Content) > 0, item)
+	}
+	text, err := render(&yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{item}})
+	if err != nil {
+		return err
+	}
+	s.insert(s.lineStart(s.endLine(seq)+1), indent(text, seq.Column-1))
+	return nil
+}
+
+// insertFlow adds node in flow style before the closing bracket of a flow collection
+func (s *splicer) insertFlow(n *yaml.Node, open, close byte, more bool, node *yaml.Node) error {
+	flow := *node
+	flow.Style |= yaml.FlowStyle
+	text, err := render(&flow)
+	if err != nil {
+		return err
+	}
+	text = strings.TrimSuffix(text, "\n")
+	if open == '{' {
+		// a single entry mapping renders with braces
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "{"), "}")
+	}
+	if more {
+		text = ", " + text
+	}
+	end, err := s.closing(s.offset(n.Line, n.Column), open, close)
+	if err != nil {
+		return err
+	}
+	s.insert(end, text)
+	return nil
+}
+
+// closing returns the offset of the bracket closing the flow collection that starts at off
+func (s *splicer) closing(off int, open, close byte) (int, error) {
+	depth := 0
+	var quote byte
+	for i := off; i < len(s.data); i++ {
+		c := s.data[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == open || c == '[' || c == '{':
+			depth++
+		case c == close || c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				if c != close {
+					return 0, fmt.Errorf("unbalanced flow collection")
+				}
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated flow collection")
+}
+
+// endLine returns the last line of the text of a node
+func (s *splicer) endLine(n *yaml.Node) int {
+	end := n.Line
+	switch {
+	case n.Kind == yaml.ScalarNode && n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		end += strings.Count(strings.TrimRight(n.Value, "\n"), "\n") + 1
+	case n.Style&yaml.FlowStyle != 0 && (n.Kind == yaml.SequenceNode || n.Kind == yaml.MappingNode):
+		open, close := byte('['), byte(']')
+		if n.Kind == yaml.MappingNode {
+			open, close = '{', '}'
+		}
+		if off, err := s.closing(s.offset(n.Line, n.Column), open, close); err == nil {
+			end = 1 + bytes.Count(s.data[:off], []byte("\n"))
+		}
+	}
+	for _, c := range n.Content {
+		end = max(end, s.endLine(c))
+	}
+	return end
+}
+
+// lineStart returns the offset of the 1-based line, the end of the text if it has fewer lines
+func (s *splicer) lineStart(line int) int {
+	off := 0
+	for l := 1; l < line; l++ {
+		i := bytes.IndexByte(s.data[off:], '\n')
+		if i < 0 {
+			return len(s.data)
+		}
+		off += i + 1
+	}
+	return off
+}
+
+// offset converts a 1-based line and column, counted in characters, to a byte offset
+func (s *splicer) offset(line, column int) int {
+	off := s.lineStart(line)
+	for col := 1; col < column && off < len(s.data); col++ {
+		_, size := utf8.DecodeRune(s.data[off:])
+		off += size
+	}
+	return off
+}
+
+func (s *splicer) insert(off int, text string) {
+	if off == len(s.data) && off > 0 && s.data[off-1] != '\n' {
+		text = "\n" + text
+	}
+	s.data = append(s.data[:off:off], append([]byte(text), s.data[off:]...)...)
+}
+
+// render encodes a node in the indentation used by nox
+func render(n *yaml.Node) (string, error) {
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(n); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// indent prefixes every line of text with n spaces
+func indent(text string, n int) string {
+	prefix := strings.Repeat(" ", n)
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if line != "" && line != "\n" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// mappingValue returns the value of key in the mapping m, or nil
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	_, v := mappingEntry(m, key)
+	return v
+}
+
+// mappingEntry returns the key and value nodes of key in the mapping m, or nil
+func mappingEntry(m *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i], m.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// AppendRecipient adds a recipient to age.recipients of the config file at path
+func AppendRecipient(path, recipient string) error {
+	_, err := appendItem(path, []string{"age", "recipients"},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: recipient},
+		func(n *yaml.Node) bool { return n.Value == recipient })
+	return err
+}
+
+// AddFile registers a file for an app in the config file at path, creating the app if needed.
+// It returns false if the app already maps the file.
+func AddFile(path, appName string, file FileConfig) (bool, error) {
+	entry := &yaml.Node{Kind: yaml.MappingNode}
+	entry.Content = append(entry.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: "path"},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: file.Path})
+	if file.Output != "" {
+		entry.Content = append(entry.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: "output"},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: file.Output})
+	}
+	return appendItem(path, []string{"apps", appName, "files"}, entry, func(n *yaml.Node) bool {
+		p := mappingValue(n, "path")
+		return p != nil && p.Value == file.Path
+	})
+}
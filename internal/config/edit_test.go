@@ -0,0 +1,198 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// editConfig writes input to a config file, applies edit and returns the resulting text
+func editConfig(t *testing.T, input string, edit func(path string) error) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := edit(path); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAppendRecipient(t *testing.T) {
+	const key = "age1new"
+	tests := []struct {
+		name, input, want string
+	}{
+		{
+			name:  "empty document",
+			input: "",
+			want:  "age:\n  recipients:\n    - age1new\n",
+		},
+		{
+			name:  "block sequence",
+			input: "age:\n  identity: key.txt # local key\n  recipients:\n    - age1old\n\ngit:\n  branch: main\n",
+			want:  "age:\n  identity: key.txt # local key\n  recipients:\n    - age1old\n    - age1new\n\ngit:\n  branch: main\n",
+		},
+		{
+			name:  "flow sequence",
+			input: "age:\n  recipients: [age1old, \"age1]x\"] # team\n",
+			want:  "age:\n  recipients: [age1old, \"age1]x\", age1new] # team\n",
+		},
+		{
+			name:  "empty flow sequence",
+			input: "age:\n  recipients: []\n",
+			want:  "age:\n  recipients: [age1new]\n",
+		},
+		{
+			name:  "null value",
+			input: "age:\n  recipients: ~\ninterval: 1m\n",
+			want:  "age:\n  recipients:\n    - age1new\ninterval: 1m\n",
+		},
+		{
+			name:  "empty value",
+			input: "age:\n  recipients:\ninterval: 1m\n",
+			want:  "age:\n  recipients:\n    - age1new\ninterval: 1m\n",
+		},
+		{
+			name:  "missing key at EOF without newline",
+			input: "interval: 1m\nage:\n  identity: key.txt",
+			want:  "interval: 1m\nage:\n  identity: key.txt\n  recipients:\n    - age1new\n",
+		},
+		{
+			name:  "missing mapping",
+			input: "interval: 1m\n",
+			want:  "interval: 1m\nage:\n  recipients:\n    - age1new\n",
+		},
+		{
+			name:  "flow mapping",
+			input: "age: {identity: key.txt}\n",
+			want:  "age: {identity: key.txt, recipients: [age1new]}\n",
+		},
+		{
+			name:  "multi-byte characters before the value",
+			input: "age: {identity: \"€€€€€€€€.txt\", recipients: [ \"ä\" ]}\n",
+			want:  "age: {identity: \"€€€€€€€€.txt\", recipients: [ \"ä\" , age1new]}\n",
+		},
+		{
+			name:  "already present",
+			input: "age:\n  recipients: [age1new] # keep\n",
+			want:  "age:\n  recipients: [age1new] # keep\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := editConfig(t, tt.input, func(path string) error { return AppendRecipient(path, key) })
+			if got != tt.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	file := FileConfig{Path: "api/prod.env.age", Output: "./secrets/api.env"}
+	tests := []struct {
+		name, input, want string
+		added             bool
+	}{
+		{
+			name:  "new app",
+			input: "interval: 1m\napps:\n  web:\n    files:\n      - path: web.env.age\n",
+			want: "interval: 1m\napps:\n  web:\n    files:\n      - path: web.env.age\n" +
+				"  api:\n    files:\n      - path: api/prod.env.age\n        output: ./secrets/api.env\n",
+			added: true,
+		},
+		{
+			name: "block sequence",
+			input: "apps:\n  api:\n    files:\n      - path: api/dev.env.age # dev\n        output: dev.env\n" +
+				"    recipients: [ops]\n",
+			want: "apps:\n  api:\n    files:\n      - path: api/dev.env.age # dev\n        output: dev.env\n" +
+				"      - path: api/prod.env.age\n        output: ./secrets/api.env\n    recipients: [ops]\n",
+			added: true,
+		},
+		{
+			name:  "flow sequence",
+			input: "apps:\n  api:\n    files: [{path: a.age}]\n",
+			want:  "apps:\n  api:\n    files: [{path: a.age}, {path: api/prod.env.age, output: ./secrets/api.env}]\n",
+			added: true,
+		},
+		{
+			name:  "null apps",
+			input: "interval: 1m\napps: null\nstatePath: state.json\n",
+			want: "interval: 1m\napps:\n  api:\n    files:\n      - path: api/prod.env.age\n        output: ./secrets/api.env\n" +
+				"statePath: state.json\n",
+			added: true,
+		},
+		{
+			name:  "null app",
+			input: "apps:\n  api:\n",
+			want:  "apps:\n  api:\n    files:\n      - path: api/prod.env.age\n        output: ./secrets/api.env\n",
+			added: true,
+		},
+		{
+			name:  "missing key at EOF",
+			input: "apps:\n  api:\n    recipients:\n      - ops",
+			want: "apps:\n  api:\n    recipients:\n      - ops\n" +
+				"    files:\n      - path: api/prod.env.age\n        output: ./secrets/api.env\n",
+			added: true,
+		},
+		{
+			name:  "literal block before the end",
+			input: "apps:\n  api:\n    files:\n      - path: a.age\n    note: |\n      first\n      second\n",
+			want: "apps:\n  api:\n    files:\n      - path: a.age\n      - path: api/prod.env.age\n        output: ./secrets/api.env\n" +
+				"    note: |\n      first\n      second\n",
+			added: true,
+		},
+		{
+			name:  "multi-byte characters before the value",
+			input: "apps: {\"äpp\": {files: [{path: \"€€€€€€€€€€€€€€€€.age\"}]}, api: {files: [{path: a.age}]}}\n",
+			want: "apps: {\"äpp\": {files: [{path: \"€€€€€€€€€€€€€€€€.age\"}]}, api: {files: [{path: a.age}, " +
+				"{path: api/prod.env.age, output: ./secrets/api.env}]}}\n",
+			added: true,
+		},
+		{
+			name:  "already mapped",
+			input: "apps:\n  api:\n    files:\n      - path: api/prod.env.age\n",
+			want:  "apps:\n  api:\n    files:\n      - path: api/prod.env.age\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var added bool
+			got := editConfig(t, tt.input, func(path string) (err error) {
+				added, err = AddFile(path, "api", file)
+				return err
+			})
+			if added != tt.added {
+				t.Fatalf("added = %v, want %v", added, tt.added)
+			}
+			if got != tt.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddFileErrors(t *testing.T) {
+	for _, input := range []string{
+		"apps: [api]\n",
+		"apps:\n  api:\n    files: a.age\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(input), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AddFile(path, "api", FileConfig{Path: "b.age"}); err == nil {
+			t.Errorf("AddFile on %q: expected an error", input)
+		}
+		data, _ := os.ReadFile(path)
+		if string(data) != input {
+			t.Errorf("AddFile on %q modified the file:\n%s", input, data)
+		}
+	}
+}
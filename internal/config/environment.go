@@ -0,0 +1,121 @@
+package config
+
+import (
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvironmentEnv selects the environment if --env is not given
+const EnvironmentEnv = "NOX_ENV"
+
+// Environment overrides parts of the config, like the branch or output paths of production hosts
+type Environment struct {
+	GitConfig GitConfig `yaml:"git,omitempty"`
+	Age       struct {
+		Identity       string   `yaml:"identity,omitempty"`
+		Identities     []string `yaml:"identities,omitempty"`
+		PassphraseFile string   `yaml:"passphraseFile,omitempty"`
+	} `yaml:"age,omitempty"`
+	// OutputRoot is prepended to every relative output path
+	OutputRoot string                 `yaml:"outputRoot,omitempty"`
+	Apps       map[string]AppOverride `yaml:"apps,omitempty"`
+}
+
+// AppOverride replaces the fields of an app that are set
+type AppOverride struct {
+	GitConfig  GitConfig     `yaml:"git,omitempty"`
+	Files      []FileConfig  `yaml:"files,omitempty"`
+	Recipients []string      `yaml:"recipients,omitempty"`
+	Backup     *BackupConfig `yaml:"backup,omitempty"`
+}
+
+var environment string
+
+// SetEnvironment selects the environment applied by Load, empty for none
+func SetEnvironment(name string) {
+	environment = name
+}
+
+// mergeGit overrides the repository and branch of base if they are set
+func mergeGit(base, override GitConfig) GitConfig {
+	if override.Repo != "" {
+		base.Repo = override.Repo
+	}
+	if override.Branch != "" {
+		base.Branch = override.Branch
+	}
+	return base
+}
+
+// applyEnvironment applies the overrides of the named environment to the config
+func (v *validator) applyEnvironment(root *yaml.Node, name string) {
+	if name == "" {
+		return
+	}
+	cfg := v.cfg
+	envs := mappingValue(root, "environments")
+	env, ok := cfg.Environments[name]
+	if !ok {
+		at := root
+		if envs != nil {
+			at = envs
+		}
+		v.addf(at, "environment %q is not defined", name)
+		return
+	}
+	cfg.Environment = name
+	envNode := mappingValue(envs, name)
+	v.env = envNode
+
+	cfg.GitConfig = mergeGit(cfg.GitConfig, env.GitConfig)
+	if env.Age.Identity != "" || len(env.Age.Identities) > 0 {
+		cfg.Age.Identity, cfg.Age.Identities = env.Age.Identity, env.Age.Identities
+	}
+	if env.Age.PassphraseFile != "" {
+		cfg.Age.PassphraseFile = env.Age.PassphraseFile
+	}
+
+	if apps := mappingValue(envNode, "apps"); apps != nil {
+		for i := 0; i+1 < len(apps.Content); i += 2 {
+			key := apps.Content[i]
+			app, ok := cfg.Apps[key.Value]
+			if !ok {
+				v.addf(key, "environment %s overrides unknown app %s", name, key.Value)
+				continue
+			}
+			override := env.Apps[key.Value]
+			if override.GitConfig != (GitConfig{}) {
+				base := app.GitConfig
+				if !base.IsValid() {
+					base = cfg.GitConfig
+				}
+				app.GitConfig = mergeGit(base, override.GitConfig)
+			}
+			if len(override.Files) > 0 {
+				app.Files = override.Files
+			}
+			if len(override.Recipients) > 0 {
+				app.Recipients = override.Recipients
+			}
+			if override.Backup != nil {
+				app.Backup = override.Backup
+			}
+			cfg.Apps[key.Value] = app
+		}
+	}
+
+	if env.OutputRoot != "" {
+		for name, app := range cfg.Apps {
+			files := make([]FileConfig, len(app.Files))
+			for i, file := range app.Files {
+				if out := file.OutputPath(); !filepath.IsAbs(out) {
+					file.Output = filepath.Join(env.OutputRoot, out)
+				}
+				files[i] = file
+			}
+			app.Files = files
+			cfg.Apps[name] = app
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expandRe matches ${VAR} and ${VAR:-default}, $${VAR} escapes a literal ${VAR}
+var expandRe = regexp.MustCompile(`\$\$?\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// fileRefPrefix marks a value that is read from a file, like file:/run/secrets/token
+const fileRefPrefix = "file:"
+
+// expand replaces environment variables in every scalar value of the document and
+// resolves file references, relative paths are resolved against baseDir
+func (v *validator) expand(node *yaml.Node, baseDir string) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			v.expand(child, baseDir)
+		}
+	case yaml.MappingNode:
+		// keys are never expanded
+		for i := 1; i < len(node.Content); i += 2 {
+			v.expand(node.Content[i], baseDir)
+		}
+	case yaml.ScalarNode:
+		v.expandScalar(node, baseDir)
+	}
+}
+
+func (v *validator) expandScalar(node *yaml.Node, baseDir string) {
+	value := expandRe.ReplaceAllStringFunc(node.Value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		m := expandRe.FindStringSubmatch(match)
+		env, ok := os.LookupEnv(m[1])
+		if m[2] != "" {
+			if env == "" {
+				return strings.TrimPrefix(m[2], ":-")
+			}
+			return env
+		}
+		if !ok {
+			v.addf(node, "environment variable %s is not set, use ${%s:-default} for a fallback", m[1], m[1])
+		}
+		return env
+	})
+
+	// file:// is a git URL, not a reference
+	if strings.HasPrefix(value, fileRefPrefix) && !strings.HasPrefix(value, "file://") {
+		path := strings.TrimPrefix(value, fileRefPrefix)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			v.addf(node, "cannot read referenced file: %v", err)
+			return
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if value == node.Value {
+		return
+	}
+	if v.cfg.references == nil {
+		v.cfg.references = make(map[string]string)
+	}
+	v.cfg.references[value] = node.Value
+	node.Value = value
+	// let plain scalars resolve their type again, ${KEEP:-5} may become an int
+	if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+		node.Tag = ""
+	}
+}
+
+// MarshalUnexpanded encodes out as YAML, values that were expanded from an environment variable
+// or a file are written as referenced in the config so secrets like tokens are not printed
+func (c *Config) MarshalUnexpanded(out any) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(out); err != nil {
+		return nil, err
+	}
+	var unexpand func(n *yaml.Node)
+	unexpand = func(n *yaml.Node) {
+		if n.Kind == yaml.ScalarNode {
+			if ref, ok := c.references[n.Value]; ok {
+				n.Value, n.Tag, n.Style = ref, "!!str", 0
+			}
+			return
+		}
+		for i, child := range n.Content {
+			// keys are never expanded
+			if n.Kind == yaml.MappingNode && i%2 == 0 {
+				continue
+			}
+			unexpand(child)
+		}
+	}
+	unexpand(&node)
+	return yaml.Marshal(&node)
+}
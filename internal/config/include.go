@@ -0,0 +1,185 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dropInDir next to the config file is included without being listed
+const dropInDir = ".nox.d"
+
+// fragment is an included file, it contributes apps, recipients and recipient groups
+type fragment struct {
+	Age struct {
+		Recipients []string            `yaml:"recipients,omitempty"`
+		Groups     map[string][]string `yaml:"groups,omitempty"`
+	} `yaml:"age,omitempty"`
+	Apps map[string]AppConfig `yaml:"apps"`
+}
+
+// document is a parsed config file, file is empty for the main config file
+type document struct {
+	file string
+	root *yaml.Node
+}
+
+// origin locates a definition in the config files
+type origin struct {
+	file         string
+	line, column int
+}
+
+func (o origin) at(mainPath string) string {
+	file := o.file
+	if file == "" {
+		file = mainPath
+	}
+	return fmt.Sprintf("%s:%d:%d", file, o.line, o.column)
+}
+
+// includeFragments merges the files matched by the include globs and the drop-in directory
+// into the config, in that order and sorted by name within each glob. It returns the documents
+// of all config files, starting with the main file.
+func (v *validator) includeFragments(path string, root *yaml.Node) ([]document, error) {
+	cfg := v.cfg
+	cfg.appFiles = make(map[string]string)
+	v.recordOrigins(path, root)
+	docs := []document{{root: root}}
+
+	baseDir := filepath.Dir(path)
+	mainAbs, _ := filepath.Abs(path)
+	seen := map[string]bool{mainAbs: true}
+
+	var files []string
+	addMatches := func(node *yaml.Node, pattern string) {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			v.addf(node, "invalid include pattern %q: %v", pattern, err)
+			return
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[`) {
+			v.addf(node, "included file %s does not exist", pattern)
+		}
+		slices.Sort(matches)
+		for _, m := range matches {
+			abs, _ := filepath.Abs(m)
+			if !seen[abs] {
+				seen[abs] = true
+				files = append(files, m)
+			}
+		}
+	}
+	includeNode := mappingValue(root, "include")
+	for i, pattern := range cfg.Include {
+		node := root
+		if includeNode != nil && i < len(includeNode.Content) {
+			node = includeNode.Content[i]
+		}
+		addMatches(node, pattern)
+	}
+	addMatches(root, filepath.Join(dropInDir, "*.yaml"))
+	addMatches(root, filepath.Join(dropInDir, "*.yml"))
+
+	for _, file := range files {
+		doc, err := v.mergeFragment(file, path)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// recordOrigins remembers where the apps and groups of the main config file are defined
+func (v *validator) recordOrigins(path string, root *yaml.Node) {
+	if apps := mappingValue(root, "apps"); apps != nil {
+		for i := 0; i+1 < len(apps.Content); i += 2 {
+			key := apps.Content[i]
+			v.appOrigins[key.Value] = origin{line: key.Line, column: key.Column}
+			v.cfg.appFiles[key.Value] = path
+		}
+	}
+	if ageNode := mappingValue(root, "age"); ageNode != nil {
+		if groups := mappingValue(ageNode, "groups"); groups != nil {
+			for i := 0; i+1 < len(groups.Content); i += 2 {
+				key := groups.Content[i]
+				v.groupOrigins[key.Value] = origin{line: key.Line, column: key.Column}
+			}
+		}
+	}
+}
+
+// mergeFragment adds the apps, recipients and groups of an included file to the config.
+// Apps and groups that are already defined are reported as conflicts and skipped.
+func (v *validator) mergeFragment(file, mainPath string) (document, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return document{}, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return document{}, fmt.Errorf("%s: %w", file, err)
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Line: 1, Column: 1}
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+
+	v.file = file
+	defer func() { v.file = "" }()
+
+	v.expand(root, filepath.Dir(file))
+	var frag fragment
+	if err := root.Decode(&frag); err != nil {
+		return document{}, fmt.Errorf("%s: %w", file, err)
+	}
+	v.knownFields(root, reflect.TypeOf(frag), "")
+
+	cfg := v.cfg
+	if apps := mappingValue(root, "apps"); apps != nil {
+		for i := 0; i+1 < len(apps.Content); i += 2 {
+			key := apps.Content[i]
+			if prev, ok := v.appOrigins[key.Value]; ok {
+				v.addf(key, "app %s is already defined at %s", key.Value, prev.at(mainPath))
+				continue
+			}
+			v.appOrigins[key.Value] = origin{file: file, line: key.Line, column: key.Column}
+			if cfg.Apps == nil {
+				cfg.Apps = make(map[string]AppConfig)
+			}
+			cfg.Apps[key.Value] = frag.Apps[key.Value]
+			cfg.appFiles[key.Value] = file
+		}
+	}
+	if ageNode := mappingValue(root, "age"); ageNode != nil {
+		if groups := mappingValue(ageNode, "groups"); groups != nil {
+			for i := 0; i+1 < len(groups.Content); i += 2 {
+				key := groups.Content[i]
+				if prev, ok := v.groupOrigins[key.Value]; ok {
+					v.addf(key, "recipient group %s is already defined at %s", key.Value, prev.at(mainPath))
+					continue
+				}
+				v.groupOrigins[key.Value] = origin{file: file, line: key.Line, column: key.Column}
+				if cfg.Age.Groups == nil {
+					cfg.Age.Groups = make(map[string][]string)
+				}
+				cfg.Age.Groups[key.Value] = frag.Age.Groups[key.Value]
+			}
+		}
+	}
+	for _, r := range frag.Age.Recipients {
+		if !slices.Contains(cfg.Age.Recipients, r) {
+			cfg.Age.Recipients = append(cfg.Age.Recipients, r)
+		}
+	}
+	return document{file: file, root: root}, nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoRecipients is returned by RecipientsFor when neither the file, its app nor the config list recipients
+var ErrNoRecipients = errors.New("no recipients configured")
+
+// isRecipientKey reports whether s is a literal recipient rather than a group reference
+func isRecipientKey(s string) bool {
+	return strings.HasPrefix(s, "age1") || strings.HasPrefix(s, "ssh-")
+}
+
+// ResolveRecipients expands references to recipient groups in the given list.
+// Groups may reference other groups, duplicates are removed.
+func (c *Config) ResolveRecipients(list []string) ([]string, error) {
+	var resolved []string
+	seen := make(map[string]bool)
+
+	var expand func(entries []string, stack []string) error
+	expand = func(entries []string, stack []string) error {
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if isRecipientKey(entry) {
+				if !seen[entry] {
+					seen[entry] = true
+					resolved = append(resolved, entry)
+				}
+				continue
+			}
+			group, ok := c.Age.Groups[entry]
+			if !ok {
+				return fmt.Errorf("unknown recipient group %q", entry)
+			}
+			for _, name := range stack {
+				if name == entry {
+					return fmt.Errorf("recipient group %q references itself", entry)
+				}
+			}
+			if err := expand(group, append(stack, entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := expand(list, nil); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// RecipientsFor returns the resolved recipients of a file of an app. The most specific
+// list wins: file recipients, then app recipients, then the global age recipients.
+// file may be nil to get the recipients of the app.
+func (c *Config) RecipientsFor(appName string, file *FileConfig) ([]string, error) {
+	list := c.Age.Recipients
+	if app, ok := c.Apps[appName]; ok && len(app.Recipients) > 0 {
+		list = app.Recipients
+	}
+	if file != nil && len(file.Recipients) > 0 {
+		list = file.Recipients
+	}
+	recipients, err := c.ResolveRecipients(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("%w for app %s", ErrNoRecipients, appName)
+	}
+	return recipients, nil
+}
+
+// FindFile returns the file of an app with the given repository path
+func (a AppConfig) FindFile(path string) (*FileConfig, bool) {
+	for i := range a.Files {
+		if a.Files[i].Path == path {
+			return &a.Files[i], true
+		}
+	}
+	return nil, false
+}
+
+// AllRecipients returns every literal recipient mentioned anywhere in the configuration
+func (c *Config) AllRecipients() []string {
+	var all []string
+	seen := make(map[string]bool)
+	add := func(list []string) {
+		for _, entry := range list {
+			entry = strings.TrimSpace(entry)
+			if isRecipientKey(entry) && !seen[entry] {
+				seen[entry] = true
+				all = append(all, entry)
+			}
+		}
+	}
+	add(c.Age.Recipients)
+	for _, group := range c.Age.Groups {
+		add(group)
+	}
+	for _, app := range c.Apps {
+		add(app.Recipients)
+		for _, file := range app.Files {
+			add(file.Recipients)
+		}
+	}
+	return all
+}
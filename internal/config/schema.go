@@ -0,0 +1,71 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// schemaRequired lists the keys that must be set in a mapping of the given type
+var schemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(Config{}):     {"interval"},
+	reflect.TypeOf(FileConfig{}): {"path"},
+}
+
+// Schema returns a JSON Schema of the config file for editor validation and autocompletion
+func Schema() ([]byte, error) {
+	schema := schemaFor(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "nox configuration"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaFor derives the schema of a type from the same YAML tags the strict parser checks
+func schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(Extends{}) {
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := yamlFields(t)
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		properties := make(map[string]any, len(fields))
+		for _, name := range names {
+			properties[name] = schemaFor(fields[name])
+		}
+		schema := map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if required, ok := schemaRequired[t]; ok {
+			schema["required"] = required
+		}
+		if t == reflect.TypeOf(Config{}) {
+			properties["interval"] = map[string]any{
+				"type":    "string",
+				"pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+			}
+		}
+		return schema
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	}
+	return map[string]any{"type": "string"}
+}
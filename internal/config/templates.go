@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extends names the templates an app or template inherits from, a single name or a list
+type Extends []string
+
+func (e *Extends) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = Extends{node.Value}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*e = list
+	return nil
+}
+
+// Effective returns the resolved config without the sections that only feed its resolution,
+// like templates and environments
+func (c *Config) Effective() *Config {
+	effective := *c
+	effective.Include = nil
+	effective.Defaults = nil
+	effective.Templates = nil
+	effective.Environments = nil
+	return &effective
+}
+
+// mergeApp returns base with the fields set in override merged in. Git and backup settings
+// are merged field by field, files are matched by path and recipients are replaced.
+func mergeApp(base, override AppConfig) AppConfig {
+	merged := base
+	merged.GitConfig = mergeGit(base.GitConfig, override.GitConfig)
+	merged.Files = mergeFiles(base.Files, override.Files)
+	if len(override.Recipients) > 0 {
+		merged.Recipients = override.Recipients
+	}
+	if override.Backup != nil {
+		if base.Backup == nil {
+			merged.Backup = override.Backup
+		} else {
+			backup := *base.Backup
+			if override.Backup.Keep != 0 {
+				backup.Keep = override.Backup.Keep
+			}
+			if override.Backup.Dir != "" {
+				backup.Dir = override.Backup.Dir
+			}
+			if len(override.Backup.Recipients) > 0 {
+				backup.Recipients = override.Backup.Recipients
+			}
+			merged.Backup = &backup
+		}
+	}
+	merged.Extends = nil
+	return merged
+}
+
+// mergeFiles appends the files of override to base, a file with a path already in base updates it
+func mergeFiles(base, override []FileConfig) []FileConfig {
+	merged := append([]FileConfig(nil), base...)
+	for _, file := range override {
+		i := 0
+		for i < len(merged) && merged[i].Path != file.Path {
+			i++
+		}
+		if i == len(merged) {
+			merged = append(merged, file)
+			continue
+		}
+		if file.Output != "" {
+			merged[i].Output = file.Output
+		}
+		if len(file.Recipients) > 0 {
+			merged[i].Recipients = file.Recipients
+		}
+	}
+	return merged
+}
+
+// resolveTemplates merges the defaults and the extended templates into every app
+func (v *validator) resolveTemplates(docs []document) {
+	cfg := v.cfg
+	resolved := make(map[string]AppConfig)
+	var resolve func(name string, stack []string) (AppConfig, error)
+	resolve = func(name string, stack []string) (AppConfig, error) {
+		if t, ok := resolved[name]; ok {
+			return t, nil
+		}
+		for _, s := range stack {
+			if s == name {
+				return AppConfig{}, fmt.Errorf("template %s extends itself: %s", name, strings.Join(append(stack, name), " -> "))
+			}
+		}
+		t, ok := cfg.Templates[name]
+		if !ok {
+			return AppConfig{}, fmt.Errorf("unknown template %q", name)
+		}
+		var base AppConfig
+		for _, parent := range t.Extends {
+			p, err := resolve(parent, append(stack, name))
+			if err != nil {
+				return AppConfig{}, err
+			}
+			base = mergeApp(base, p)
+		}
+		t = mergeApp(base, t)
+		resolved[name] = t
+		return t, nil
+	}
+
+	for _, doc := range docs {
+		v.file = doc.file
+		apps := mappingValue(doc.root, "apps")
+		if apps == nil {
+			continue
+		}
+		for i := 0; i+1 < len(apps.Content); i += 2 {
+			key, node := apps.Content[i], apps.Content[i+1]
+			if v.appOrigins[key.Value].file != doc.file {
+				continue
+			}
+			app := cfg.Apps[key.Value]
+			if cfg.Defaults == nil && len(app.Extends) == 0 {
+				continue
+			}
+			var base AppConfig
+			if cfg.Defaults != nil {
+				base = mergeApp(base, *cfg.Defaults)
+			}
+			for _, name := range app.Extends {
+				t, err := resolve(name, nil)
+				if err != nil {
+					at := key
+					if ext := mappingValue(node, "extends"); ext != nil {
+						at = ext
+					}
+					v.addf(at, "app %s: %v", key.Value, err)
+					continue
+				}
+				base = mergeApp(base, t)
+			}
+			cfg.Apps[key.Value] = mergeApp(base, app)
+		}
+	}
+	v.file = ""
+}
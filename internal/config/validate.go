@@ -0,0 +1,448 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aottr/nox/internal/crypto"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an issue found at a line and column of the config file
+type Problem struct {
+	// File is set for problems in included files
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// ValidationError lists every problem found in a config file
+type ValidationError struct {
+	Path     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		file := e.Path
+		if p.File != "" {
+			file = p.File
+		}
+		lines[i] = fmt.Sprintf("%s:%d:%d: %s", file, p.Line, p.Column, p.Message)
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// Check loads the config file like Load and additionally verifies that the configured
+// identity files are readable. All problems are returned in one *ValidationError.
+func Check(path string) (*Config, error) {
+	return parse(path, true)
+}
+
+// parse decodes the config file strictly and validates it
+func parse(path string, checkIdentities bool) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Line: 1, Column: 1}
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+
+	var cfg Config
+	v := &validator{
+		cfg:          &cfg,
+		outputs:      make(map[string]fileOwner),
+		appOrigins:   make(map[string]origin),
+		groupOrigins: make(map[string]origin),
+	}
+	v.expand(root, filepath.Dir(path))
+	if err := root.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	v.knownFields(root, reflect.TypeOf(cfg), "")
+
+	docs, err := v.includeFragments(path, root)
+	if err != nil {
+		return nil, err
+	}
+	v.resolveTemplates(docs)
+	// the merged config is validated, values overridden by the environment are reported at the environment
+	v.applyEnvironment(root, environment)
+	v.validate(root)
+	for _, doc := range docs {
+		v.file = doc.file
+		v.validateAge(mappingValue(doc.root, "age"))
+		v.validateApps(mappingValue(doc.root, "apps"))
+	}
+	v.file = ""
+	cfg.resolvePaths(filepath.Dir(path), func(app, key string) string {
+		// values set by the environment are written in the main config file
+		if file := cfg.appFiles[app]; file != "" && v.envValue("apps", app, key) == nil {
+			return filepath.Dir(file)
+		}
+		return filepath.Dir(path)
+	})
+	if checkIdentities {
+		v.identities(root)
+	}
+	if len(v.problems) > 0 {
+		// problems of the main file come first
+		sort.SliceStable(v.problems, func(i, j int) bool {
+			a, b := v.problems[i], v.problems[j]
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+		})
+		return nil, &ValidationError{Path: path, Problems: v.problems}
+	}
+
+	cfg.Interval, _ = time.ParseDuration(cfg.IntervalString)
+	return &cfg, nil
+}
+
+type validator struct {
+	cfg      *Config
+	problems []Problem
+	// file is the included file being checked, empty for the main config file
+	file string
+	// outputs are compared across apps, the first app writing a path owns it
+	outputs map[string]fileOwner
+	// appOrigins and groupOrigins locate the definition of every app and recipient group
+	appOrigins   map[string]origin
+	groupOrigins map[string]origin
+	// env is the node of the selected environment, nil without one
+	env *yaml.Node
+}
+
+type fileOwner struct{ app, path string }
+
+func (v *validator) addf(node *yaml.Node, format string, args ...any) {
+	v.problems = append(v.problems, Problem{File: v.file, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+// envValue returns the node the selected environment sets at the keys, nil if it does not override them
+func (v *validator) envValue(keys ...string) *yaml.Node {
+	node := v.env
+	for _, key := range keys {
+		if node == nil {
+			return nil
+		}
+		node = mappingValue(node, key)
+	}
+	return node
+}
+
+// inEnvironment runs check reporting problems in the main config file, which defines the environments
+func (v *validator) inEnvironment(check func()) {
+	file := v.file
+	v.file = ""
+	check()
+	v.file = file
+}
+
+// yamlFields maps the YAML keys of a struct to their field types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// knownFields reports keys of the document that do not exist in the config structs
+func (v *validator) knownFields(node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				v.knownFields(value, t, path)
+				continue
+			}
+			ft, ok := fields[key.Value]
+			if !ok {
+				v.addf(key, "unknown key %q in %s%s", key.Value, describePath(path), suggestField(fields, key.Value))
+				continue
+			}
+			v.knownFields(value, ft, joinPath(path, key.Value))
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.knownFields(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			v.knownFields(item, t.Elem(), path+"["+strconv.Itoa(i)+"]")
+		}
+	}
+}
+
+// suggestField points to a nested field with the same name, like git.branch for branch
+func suggestField(fields map[string]reflect.Type, key string) string {
+	var names []string
+	for name, ft := range fields {
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct {
+			continue
+		}
+		if _, ok := yamlFields(ft)[key]; ok {
+			names = append(names, name+"."+key)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return ", did you mean " + strings.Join(names, " or ") + "?"
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "the top level"
+	}
+	return path
+}
+
+// validate checks the values of the config and reports them at their position in the document
+func (v *validator) validate(root *yaml.Node) {
+	cfg := v.cfg
+
+	if node := mappingValue(root, "interval"); node == nil {
+		v.addf(root, "interval is required")
+	} else if d, err := time.ParseDuration(cfg.IntervalString); err != nil {
+		v.addf(node, "invalid interval %q: use a duration like 10m or 1h", cfg.IntervalString)
+	} else if d <= 0 {
+		v.addf(node, "interval must be positive")
+	}
+
+	globalGit := cfg.GitConfig.IsValid()
+	if !globalGit {
+		if node := v.envValue("git"); node != nil {
+			v.addf(node, "git of environment %s needs both repo and branch", cfg.Environment)
+		} else if node := mappingValue(root, "git"); node != nil {
+			v.addf(node, "git needs both repo and branch")
+		}
+	}
+
+	if len(cfg.Apps) == 0 && !globalGit {
+		v.addf(root, "no git configuration found: set either top-level git or app-specific git")
+	}
+}
+
+// validateAge checks the recipients and groups of an age section
+func (v *validator) validateAge(node *yaml.Node) {
+	if node == nil {
+		return
+	}
+	if recipients := mappingValue(node, "recipients"); recipients != nil && recipients.Kind == yaml.SequenceNode {
+		for _, item := range recipients.Content {
+			v.recipients(item, []string{item.Value})
+		}
+	}
+	if groups := mappingValue(node, "groups"); groups != nil && groups.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(groups.Content); i += 2 {
+			v.recipients(groups.Content[i+1], v.cfg.Age.Groups[groups.Content[i].Value])
+		}
+	}
+}
+
+// validateApps checks the apps defined in an apps section
+func (v *validator) validateApps(apps *yaml.Node) {
+	if apps == nil || apps.Kind != yaml.MappingNode {
+		return
+	}
+	cfg := v.cfg
+	globalGit := cfg.GitConfig.IsValid()
+	for i := 0; i+1 < len(apps.Content); i += 2 {
+		nameNode, appNode := apps.Content[i], apps.Content[i+1]
+		name := nameNode.Value
+		if strings.TrimSpace(name) == "" {
+			v.addf(nameNode, "app name must not be empty")
+			continue
+		}
+		if v.appOrigins[name].file != v.file {
+			// a conflicting definition, already reported
+			continue
+		}
+		app := cfg.Apps[name]
+
+		// git, recipients and files may come from the defaults or templates of the app
+		gitNode := mappingValue(appNode, "git")
+		switch envGit := v.envValue("apps", name, "git"); {
+		case app.GitConfig.IsValid():
+		case envGit != nil:
+			v.inEnvironment(func() {
+				v.addf(envGit, "git of app %s in environment %s needs both repo and branch", name, cfg.Environment)
+			})
+		case gitNode != nil || app.GitConfig != (GitConfig{}):
+			at := nameNode
+			if gitNode != nil {
+				at = gitNode
+			}
+			v.addf(at, "git of app %s needs both repo and branch", name)
+		case !globalGit:
+			v.addf(nameNode, "app %s has no git configuration and no top-level git is set", name)
+		}
+
+		if node := v.envValue("apps", name, "recipients"); node != nil {
+			v.inEnvironment(func() { v.recipients(node, app.Recipients) })
+		} else {
+			v.recipients(mappingValue(appNode, "recipients"), app.Recipients)
+		}
+
+		if len(app.Files) == 0 {
+			v.addf(nameNode, "app %s has no files", name)
+			continue
+		}
+		if node := v.envValue("apps", name, "files"); node != nil {
+			v.inEnvironment(func() { v.validateFiles(name, app.Files, v.envValue("apps", name), node) })
+		} else {
+			v.validateFiles(name, app.Files, appNode, nameNode)
+		}
+	}
+}
+
+// validateFiles checks the files of an app defined in appNode, problems of files without a node of their own
+// are reported at fallback
+func (v *validator) validateFiles(name string, files []FileConfig, appNode, fallback *yaml.Node) {
+	for j, file := range files {
+		fileNode := fileNodeFor(appNode, file.Path, j)
+		if fileNode == nil {
+			fileNode = fallback
+		}
+		if strings.TrimSpace(file.Path) == "" {
+			v.addf(fileNode, "file %d of app %s has an empty path", j+1, name)
+			continue
+		}
+		v.recipients(mappingValue(fileNode, "recipients"), file.Recipients)
+
+		out := filepath.Clean(file.OutputPath())
+		if prev, ok := v.outputs[out]; ok {
+			at := fileNode
+			if node := mappingValue(fileNode, "output"); node != nil {
+				at = node
+			}
+			v.addf(at, "output %s of %s in app %s is already written by %s of app %s", out, file.Path, name, prev.path, prev.app)
+			continue
+		}
+		v.outputs[out] = fileOwner{app: name, path: file.Path}
+	}
+}
+
+// fileNodeFor returns the node of the file with the given path in the files of an app,
+// or by index for files without path. It is nil for files inherited from templates.
+func fileNodeFor(appNode *yaml.Node, path string, index int) *yaml.Node {
+	files := mappingValue(appNode, "files")
+	if files == nil {
+		return nil
+	}
+	for _, item := range files.Content {
+		if p := mappingValue(item, "path"); p != nil && p.Value == path {
+			return item
+		}
+	}
+	if path == "" && index < len(files.Content) {
+		return files.Content[index]
+	}
+	return nil
+}
+
+// recipients reports references to unknown or cyclic recipient groups
+func (v *validator) recipients(node *yaml.Node, list []string) {
+	if node == nil || len(list) == 0 {
+		return
+	}
+	if _, err := v.cfg.ResolveRecipients(list); err != nil {
+		v.addf(node, "%v", err)
+	}
+}
+
+// identities reports configured identity files that cannot be read
+func (v *validator) identities(root *yaml.Node) {
+	if len(v.cfg.IdentitySources()) == 0 {
+		v.addf(root, "no age identity configured: set age.identity or age.identities")
+		return
+	}
+	ageNode := mappingValue(root, "age")
+	if v.envValue("age", "identity") != nil || v.envValue("age", "identities") != nil {
+		// the environment replaces the identities of the config
+		ageNode = v.envValue("age")
+	}
+	if ageNode == nil {
+		return
+	}
+	check := func(node *yaml.Node, path string) {
+		if path == "" || crypto.IsIdentitySource(path) {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			v.addf(node, "identity %s is not readable: %v", path, err)
+			return
+		}
+		f.Close()
+	}
+	if node := mappingValue(ageNode, "identity"); node != nil && v.cfg.Age.Identity != "" {
+		check(node, v.cfg.Age.Identity)
+		return
+	}
+	if node := mappingValue(ageNode, "identities"); node != nil && node.Kind == yaml.SequenceNode {
+		for i, item := range node.Content {
+			if i < len(v.cfg.Age.Identities) {
+				check(item, v.cfg.Age.Identities[i])
+			}
+		}
+	}
+}
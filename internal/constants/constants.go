@@ -3,6 +3,19 @@ package constants
 const (
 	DefaultStatePath  = ".nox-state.json"
 	DefaultConfigPath = ".nox.yaml"
+	DefaultBackupDir  = ".nox-backups"
 	StandardOutput    = "<stdout>"
 	StandardInput     = "<stdin>"
 )
+
+// Exit codes returned by one-shot runs
+const (
+	ExitOK           = 0
+	ExitFailure      = 1
+	ExitConfigError  = 2
+	ExitAuthError    = 3
+	ExitFetchError   = 4
+	ExitDecryptError = 5
+	ExitWriteError   = 6
+	ExitPartial      = 7
+)
@@ -0,0 +1,21 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+
+	"filippo.io/age/armor"
+)
+
+// IsArmored reports whether data is, or starts like, an ASCII armored age file
+func IsArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armor.Header))
+}
+
+// dearmor returns a reader over the binary age file, decoding the armor if present
+func dearmor(data []byte) io.Reader {
+	if IsArmored(data) {
+		return armor.NewReader(bytes.NewReader(data))
+	}
+	return bytes.NewReader(data)
+}
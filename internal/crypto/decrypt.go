@@ -1,12 +1,14 @@
 package crypto
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"os"
 
 	"filippo.io/age"
+	"filippo.io/age/armor"
 )
 
 // DecryptFile decrypts the given file using the given identities
@@ -18,18 +20,59 @@ func DecryptFile(inputPath string, identities []age.Identity) ([]byte, error) {
 	return DecryptBytes(data, identities)
 }
 
-// DecryptBytes decrypts the given bytes using the given identities
+// DecryptBytes decrypts the given binary or armored bytes using the given identities
 func DecryptBytes(encrypted []byte, identities []age.Identity) ([]byte, error) {
+	var out bytes.Buffer
+	if err := DecryptStream(&out, bytes.NewReader(encrypted), identities); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
 
-	dec, err := age.Decrypt(bytes.NewReader(encrypted), identities...)
+// DecryptStream decrypts a binary or armored age file from src to dst chunk by chunk.
+// Every chunk is authenticated before it is written, but a failure may leave
+// a partial plaintext in dst.
+func DecryptStream(dst io.Writer, src io.Reader, identities []age.Identity) error {
+	br := bufio.NewReader(src)
+	if isArmoredStream(br) {
+		src = armor.NewReader(br)
+	} else {
+		src = br
+	}
+
+	dec, err := age.Decrypt(src, identities...)
 	if err != nil {
-		return nil, fmt.Errorf("age decryption failed: %w", err)
+		return fmt.Errorf("age decryption failed: %w", err)
 	}
 
-	var out bytes.Buffer
-	if _, err := io.Copy(&out, dec); err != nil {
-		return nil, fmt.Errorf("failed to read decrypted data: %w", err)
+	if _, err := io.Copy(dst, dec); err != nil {
+		return fmt.Errorf("failed to read decrypted data: %w", err)
+	}
+	return nil
+}
+
+// DecryptStreamAuto streams plain age files and decrypts structured documents, which
+// cannot be streamed, value by value
+func DecryptStreamAuto(dst io.Writer, src io.Reader, identities []age.Identity) error {
+	br := bufio.NewReader(src)
+	head, _ := br.Peek(len(ageIntro))
+	if string(head) == ageIntro || isArmoredStream(br) {
+		return DecryptStream(dst, br, identities)
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return err
 	}
+	plaintext, err := DecryptAuto(data, identities)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(plaintext)
+	return err
+}
 
-	return out.Bytes(), nil
+// isArmoredStream peeks at the start of the stream for the armor header
+func isArmoredStream(br *bufio.Reader) bool {
+	head, _ := br.Peek(1024)
+	return IsArmored(head)
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"filippo.io/age"
+	"filippo.io/age/armor"
 )
 
 // EncryptFile encrypts the given file using the given identities
@@ -19,23 +20,49 @@ func EncryptFile(path string, recipients []age.Recipient) ([]byte, error) {
 }
 
 func EncryptBytes(data []byte, recipients []age.Recipient) ([]byte, error) {
+	var dst bytes.Buffer
+	if err := EncryptStream(&dst, bytes.NewReader(data), recipients, false); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
+}
+
+// EncryptBytesArmored encrypts the given bytes into the ASCII armored age format
+func EncryptBytesArmored(data []byte, recipients []age.Recipient) ([]byte, error) {
+	var dst bytes.Buffer
+	if err := EncryptStream(&dst, bytes.NewReader(data), recipients, true); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
+}
 
-	src := bytes.NewReader(data)
-	dst := new(bytes.Buffer)
+// EncryptStream encrypts src to dst chunk by chunk without buffering the input,
+// optionally in the ASCII armored format
+func EncryptStream(dst io.Writer, src io.Reader, recipients []age.Recipient, armored bool) error {
+	var armorWriter io.WriteCloser
+	if armored {
+		armorWriter = armor.NewWriter(dst)
+		dst = armorWriter
+	}
 
 	enc, err := age.Encrypt(dst, recipients...)
 	if err != nil {
-		return nil, fmt.Errorf("initializing age enc failed: %w", err)
+		return fmt.Errorf("initializing age enc failed: %w", err)
 	}
 
 	if _, err := io.Copy(enc, src); err != nil {
 		enc.Close()
-		return nil, fmt.Errorf("encryption failed: %w", err)
+		return fmt.Errorf("encryption failed: %w", err)
 	}
 
 	if err := enc.Close(); err != nil {
-		return nil, fmt.Errorf("finalizing encryption failed: %w", err)
+		return fmt.Errorf("finalizing encryption failed: %w", err)
 	}
 
-	return dst.Bytes(), nil
+	if armorWriter != nil {
+		if err := armorWriter.Close(); err != nil {
+			return fmt.Errorf("finalizing armor failed: %w", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+const ageIntro = "age-encryption.org/v1"
+
+// Stanza is a recipient stanza of an age header
+type Stanza struct {
+	Type string
+	Args []string
+}
+
+// Header lists the recipient stanzas of an age file
+type Header struct {
+	Stanzas []Stanza
+}
+
+// ParseHeader reads the recipient stanzas of an age file without decrypting it.
+// For structured documents the header of the encrypted MAC is returned.
+func ParseHeader(data []byte) (*Header, error) {
+	if format, ok := DetectStructured(data); ok {
+		value, err := structuredMACValue(data, format)
+		if err != nil {
+			return nil, err
+		}
+		m := encValueRe.FindStringSubmatch(value)
+		if m == nil {
+			return nil, fmt.Errorf("%s is not encrypted", MACKey)
+		}
+		if data, err = base64.StdEncoding.DecodeString(m[1]); err != nil {
+			return nil, fmt.Errorf("invalid encrypted value: %w", err)
+		}
+	}
+
+	scanner := bufio.NewScanner(dearmor(data))
+	if !scanner.Scan() || scanner.Text() != ageIntro {
+		return nil, fmt.Errorf("not an age encrypted file")
+	}
+	header := &Header{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "-> "):
+			fields := strings.Fields(strings.TrimPrefix(line, "-> "))
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("malformed stanza")
+			}
+			header.Stanzas = append(header.Stanzas, Stanza{Type: fields[0], Args: fields[1:]})
+		case strings.HasPrefix(line, "---"):
+			return header, nil
+		}
+	}
+	return nil, fmt.Errorf("truncated age header")
+}
+
+// Counts returns the number of stanzas per stanza type
+func (h *Header) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, s := range h.Stanzas {
+		counts[s.Type]++
+	}
+	return counts
+}
+
+// Recipients returns the number of stanzas that address a recipient
+func (h *Header) Recipients() int {
+	n := 0
+	for _, s := range h.Stanzas {
+		if isKnownStanza(s.Type) {
+			n++
+		}
+	}
+	return n
+}
+
+// SSHTags returns the key tags of all ssh-ed25519 and ssh-rsa stanzas
+func (h *Header) SSHTags() []string {
+	var tags []string
+	for _, s := range h.Stanzas {
+		if (s.Type == "ssh-ed25519" || s.Type == "ssh-rsa") && len(s.Args) > 0 {
+			tags = append(tags, s.Args[0])
+		}
+	}
+	return tags
+}
+
+// isKnownStanza reports whether a stanza addresses a recipient. Everything but the
+// random grease stanzas age adds does, including stanzas of plugins.
+func isKnownStanza(t string) bool {
+	return !strings.HasSuffix(t, "-grease")
+}
+
+// SSHKeyTag returns the tag age uses to identify an SSH recipient in a stanza
+func SSHKeyTag(recipient string) (string, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(recipient))
+	if err != nil {
+		return "", fmt.Errorf("parse ssh key: %w", err)
+	}
+	h := sha256.Sum256(pk.Marshal())
+	return base64.RawStdEncoding.EncodeToString(h[:4]), nil
+}
+
+// structuredMACValue returns the raw encrypted MAC of a structured document
+func structuredMACValue(data []byte, format Format) (string, error) {
+	var mac string
+	switch format {
+	case FormatJSON, FormatYAML:
+		// JSON is valid YAML
+		var doc map[string]any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return "", fmt.Errorf("parse %s: %w", format, err)
+		}
+		mac, _ = doc[MACKey].(string)
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), MACKey+"="); ok {
+				mac = value
+			}
+		}
+	}
+	if mac == "" {
+		return "", fmt.Errorf("document has no %s", MACKey)
+	}
+	return mac, nil
+}
@@ -1,29 +1,255 @@
 package crypto
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/ssh"
 )
 
-// LoadAgeIdentities reads and parses all age identities from the given file
+// SSHPassphraseEnv holds the passphrase of encrypted SSH identities, if unset nox prompts for it
+const SSHPassphraseEnv = "NOX_SSH_IDENTITY_PASSPHRASE"
+
+// IdentityPassphraseEnv holds the passphrase of passphrase encrypted identity files
+const IdentityPassphraseEnv = "NOX_IDENTITY_PASSPHRASE"
+
+// IdentityInfo describes a loaded identity and where it came from
+type IdentityInfo struct {
+	Identity age.Identity
+	// Type is the key type, like X25519 or ssh-ed25519, or plugin:<name>
+	Type string
+	// Recipient is the public key of the identity, empty if only its plugin knows it
+	Recipient string
+	Source    string
+}
+
+// LoadAgeIdentities reads and parses all age identities from the given file.
+// OpenSSH private keys and passphrase encrypted identity files are accepted as well,
+// path may also be an identity source, see IsIdentitySource.
 func LoadAgeIdentities(path string) ([]age.Identity, error) {
-	data, err := os.ReadFile(path)
+	infos, err := LoadIdentityInfos(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read age key file: %w", err)
+		return nil, err
 	}
+	identities := make([]age.Identity, len(infos))
+	for i, info := range infos {
+		identities[i] = info.Identity
+	}
+	return identities, nil
+}
 
-	identities, err := age.ParseIdentities(bytes.NewReader(data))
+// LoadIdentityInfos is like LoadAgeIdentities but describes every identity
+func LoadIdentityInfos(path string) ([]IdentityInfo, error) {
+	data, err := readIdentitySource(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseIdentities(path, data)
+}
+
+func parseIdentities(path string, data []byte) ([]IdentityInfo, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte(ageIntro)), IsArmored(data):
+		return loadEncryptedIdentities(path, data)
+	case bytes.HasPrefix(trimmed, []byte("-----BEGIN")):
+		return loadSSHIdentity(path, data)
+	}
+
+	// plugin identities are split off, age.ParseIdentities only knows native ones
+	var native bytes.Buffer
+	var plugins []IdentityInfo
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isPluginIdentity(line) {
+			native.WriteString(line + "\n")
+			continue
+		}
+		id, err := plugin.NewIdentity(line, PluginUI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plugin identity: %w", err)
+		}
+		plugins = append(plugins, IdentityInfo{Identity: id, Type: "plugin:" + id.Name(), Source: path})
+	}
+	if len(plugins) > 0 && native.Len() == 0 {
+		return plugins, nil
+	}
+
+	nativeIdentities, err := age.ParseIdentities(&native)
 	if err != nil {
 		return nil, fmt.Errorf("invalid age identity file: %w", err)
 	}
 
-	return identities, nil
+	var infos []IdentityInfo
+	for _, id := range nativeIdentities {
+		info := IdentityInfo{Identity: id, Type: "unknown", Source: path}
+		if x, ok := id.(*age.X25519Identity); ok {
+			info.Type = "X25519"
+			info.Recipient = x.Recipient().String()
+		}
+		infos = append(infos, info)
+	}
+	return append(infos, plugins...), nil
+}
+
+// loadEncryptedIdentities unlocks an identity file that was encrypted with a passphrase, like age -p
+func loadEncryptedIdentities(path string, data []byte) ([]IdentityInfo, error) {
+	pass, err := readPassphrase(IdentityPassphraseEnv, passphraseFile, fmt.Sprintf("Enter passphrase for identity file %s: ", path))
+	if err != nil {
+		return nil, err
+	}
+	id, err := age.NewScryptIdentity(string(pass))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := DecryptBytes(data, []age.Identity{id})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock identity file %s: %w", path, err)
+	}
+	return parseIdentities(path, plaintext)
+}
+
+// loadSSHIdentity parses an OpenSSH private key. Passphrase protected keys are
+// only unlocked once a file encrypted to them is decrypted.
+func loadSSHIdentity(path string, pemBytes []byte) ([]IdentityInfo, error) {
+	id, err := agessh.ParseIdentity(pemBytes)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh identity file: %w", err)
+		}
+		return []IdentityInfo{sshIdentityInfo(id, signer.PublicKey(), path)}, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("invalid ssh identity file: %w", err)
+	}
+	pubKey := missing.PublicKey
+	if pubKey == nil {
+		// older key formats do not embed the public key, read it from the .pub file
+		pubBytes, err := os.ReadFile(path + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("encrypted ssh key %s needs its public key in %s.pub: %w", path, path, err)
+		}
+		if pubKey, _, _, _, err = ssh.ParseAuthorizedKey(pubBytes); err != nil {
+			return nil, fmt.Errorf("invalid ssh public key %s.pub: %w", path, err)
+		}
+	}
+	enc, err := agessh.NewEncryptedSSHIdentity(pubKey, pemBytes, func() ([]byte, error) {
+		return readPassphrase(SSHPassphraseEnv, "", fmt.Sprintf("Enter passphrase for %s: ", path))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh identity file: %w", err)
+	}
+	return []IdentityInfo{sshIdentityInfo(enc, pubKey, path)}, nil
+}
+
+func sshIdentityInfo(id age.Identity, pubKey ssh.PublicKey, path string) IdentityInfo {
+	return IdentityInfo{
+		Identity:  id,
+		Type:      pubKey.Type(),
+		Recipient: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))),
+		Source:    path,
+	}
+}
+
+// Fingerprint returns the SHA256 fingerprint of a recipient. SSH keys use the
+// fingerprint format of ssh-keygen, other recipients are hashed as a string.
+func Fingerprint(recipient string) (string, error) {
+	recipient = strings.TrimSpace(recipient)
+	if strings.HasPrefix(recipient, "ssh-") {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(recipient))
+		if err != nil {
+			return "", fmt.Errorf("parse ssh key: %w", err)
+		}
+		return ssh.FingerprintSHA256(pk), nil
+	}
+	if _, err := StringsToRecipients([]string{recipient}); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(recipient))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// DefaultIdentityEnv is used as identity source when no identity is configured
+const DefaultIdentityEnv = "NOX_AGE_KEY"
+
+// IsIdentitySource reports whether s names an identity source other than a file path:
+// env:NAME reads an environment variable, fd:N a file descriptor and - reads STDIN
+func IsIdentitySource(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "fd:")
+}
+
+// readIdentitySource reads the identities of an environment variable, file descriptor, STDIN or file
+func readIdentitySource(source string) ([]byte, error) {
+	switch {
+	case source == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identities from stdin: %w", err)
+		}
+		return data, nil
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		data, ok := os.LookupEnv(name)
+		if !ok || data == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(data), nil
+	case strings.HasPrefix(source, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(source, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", source)
+		}
+		f := os.NewFile(uintptr(fd), source)
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %q", source)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identities from %s: %w", source, err)
+		}
+		return data, nil
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age key file: %w", err)
+	}
+	return data, nil
+}
+
+// LoadIdentityInfosFromPaths describes the identities of all given files and identity sources
+func LoadIdentityInfosFromPaths(paths []string) ([]IdentityInfo, error) {
+	var all []IdentityInfo
+	for _, path := range paths {
+		infos, err := LoadIdentityInfos(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load identities from %s: %w", path, err)
+		}
+		all = append(all, infos...)
+	}
+	return all, nil
 }
 
+// LoadAgeIdentitiesFromPaths loads the identities of all given files and identity sources
 func LoadAgeIdentitiesFromPaths(paths []string) ([]age.Identity, error) {
 	var allIdentities []age.Identity
 
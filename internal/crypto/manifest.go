@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ManifestExt is appended to the path of an encrypted file to name its recipients manifest
+const ManifestExt = ".recipients"
+
+// ManifestPath returns the path of the recipients manifest of an encrypted file
+func ManifestPath(path string) string {
+	return path + ManifestExt
+}
+
+// WriteRecipientsManifest writes the recipients an encrypted file was encrypted to,
+// one per line, next to the file
+func WriteRecipientsManifest(path string, recipients []string) error {
+	if err := os.WriteFile(ManifestPath(path), FormatRecipientsManifest(recipients), 0644); err != nil {
+		return fmt.Errorf("write recipients manifest: %w", err)
+	}
+	return nil
+}
+
+// FormatRecipientsManifest renders a sorted, de-duplicated recipients manifest
+func FormatRecipientsManifest(recipients []string) []byte {
+	var lines []string
+	for _, r := range recipients {
+		if r = strings.TrimSpace(r); r != "" {
+			lines = append(lines, r)
+		}
+	}
+	slices.Sort(lines)
+	lines = slices.Compact(lines)
+	var b bytes.Buffer
+	b.WriteString("# recipients of the encrypted file, written by nox\n")
+	for _, l := range lines {
+		b.WriteString(l + "\n")
+	}
+	return b.Bytes()
+}
+
+// ParseRecipientsManifest returns the recipients listed in a manifest
+func ParseRecipientsManifest(data []byte) []string {
+	var recipients []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		recipients = append(recipients, line)
+	}
+	return recipients
+}
@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"filippo.io/age"
+	"golang.org/x/term"
+)
+
+// PassphraseEnv holds the passphrase for files encrypted with a passphrase instead of recipients
+const PassphraseEnv = "NOX_PASSPHRASE"
+
+var passphraseFile string
+
+// SetPassphraseFile sets a file whose content unlocks passphrase encrypted identity files
+func SetPassphraseFile(path string) {
+	passphraseFile = path
+}
+
+// readPassphrase returns the value of the environment variable env if set, then the
+// content of file if given, otherwise it prompts for a passphrase on the terminal
+func readPassphrase(env, file, prompt string) ([]byte, error) {
+	if pass, ok := os.LookupEnv(env); ok {
+		return []byte(pass), nil
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase file: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to prompt for a passphrase, set %s", env)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	pass, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fmt.Errorf("read passphrase: %w", err)
+	}
+	return pass, nil
+}
+
+// PassphraseRecipient returns an scrypt recipient for the passphrase in NOX_PASSPHRASE,
+// or prompts twice for a new passphrase
+func PassphraseRecipient() (age.Recipient, error) {
+	pass, err := readPassphrase(PassphraseEnv, "", "Enter passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := os.LookupEnv(PassphraseEnv); !ok {
+		confirm, err := readPassphrase(PassphraseEnv, "", "Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, confirm) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	return age.NewScryptRecipient(string(pass))
+}
+
+// PassphraseIdentity returns an identity for passphrase encrypted files that only
+// asks for the passphrase once such a file is decrypted
+func PassphraseIdentity() age.Identity {
+	return &lazyScryptIdentity{}
+}
+
+type lazyScryptIdentity struct{}
+
+func (*lazyScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != "scrypt" {
+			continue
+		}
+		pass, err := readPassphrase(PassphraseEnv, "", "Enter passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(string(pass))
+		if err != nil {
+			return nil, err
+		}
+		return id.Unwrap(stanzas)
+	}
+	return nil, age.ErrIncorrectIdentity
+}
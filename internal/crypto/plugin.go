@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age/plugin"
+	"golang.org/x/term"
+)
+
+// PluginUI surfaces messages and prompts of age plugins on the terminal.
+// Plugins are run as age-plugin-<name> binaries found on PATH.
+var PluginUI = &plugin.ClientUI{
+	DisplayMessage: func(name, message string) error {
+		fmt.Fprintf(os.Stderr, "age-plugin-%s: %s\n", name, message)
+		return nil
+	},
+	RequestValue: func(name, prompt string, secret bool) (string, error) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return "", fmt.Errorf("age-plugin-%s requested input but there is no terminal", name)
+		}
+		defer tty.Close()
+
+		fmt.Fprintf(tty, "age-plugin-%s: %s ", name, prompt)
+		if secret {
+			value, err := term.ReadPassword(int(tty.Fd()))
+			fmt.Fprintln(tty)
+			return string(value), err
+		}
+		value, err := bufio.NewReader(tty).ReadString('\n')
+		return strings.TrimRight(value, "\r\n"), err
+	},
+	Confirm: func(name, prompt, yes, no string) (bool, error) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return false, fmt.Errorf("age-plugin-%s requested a confirmation but there is no terminal", name)
+		}
+		defer tty.Close()
+
+		if no == "" {
+			fmt.Fprintf(tty, "age-plugin-%s: %s [press enter for %q] ", name, prompt, yes)
+			_, err := bufio.NewReader(tty).ReadString('\n')
+			return true, err
+		}
+		fmt.Fprintf(tty, "age-plugin-%s: %s [1. %s, 2. %s] ", name, prompt, yes, no)
+		answer, err := bufio.NewReader(tty).ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		switch strings.TrimSpace(answer) {
+		case "1", yes:
+			return true, nil
+		case "2", no:
+			return false, nil
+		}
+		return false, fmt.Errorf("invalid choice %q", strings.TrimSpace(answer))
+	},
+	WaitTimer: func(name string) {
+		fmt.Fprintf(os.Stderr, "waiting on age-plugin-%s...\n", name)
+	},
+}
+
+// isPluginRecipient reports whether s is an age1<name>1... plugin recipient
+func isPluginRecipient(s string) bool {
+	_, _, err := plugin.ParseRecipient(s)
+	return err == nil
+}
+
+// isPluginIdentity reports whether s is an AGE-PLUGIN-<NAME>-1... plugin identity
+func isPluginIdentity(s string) bool {
+	return strings.HasPrefix(s, "AGE-PLUGIN-")
+}
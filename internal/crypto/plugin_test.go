@@ -0,0 +1,192 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"filippo.io/age/plugin"
+)
+
+// stubPluginEnv makes the test binary act as the age-plugin-stub binary
+const stubPluginEnv = "NOX_TEST_AGE_PLUGIN_STUB"
+
+// stubKey is the identity data the stub plugin accepts
+var stubKey = []byte("stub-key")
+
+func TestMain(m *testing.M) {
+	if os.Getenv(stubPluginEnv) != "" {
+		os.Exit(runStubPlugin(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// stubStanza is a stanza of the plugin protocol, the body is kept in its encoded form
+type stubStanza struct {
+	typ  string
+	args []string
+	body string
+}
+
+func readStubStanza(r *bufio.Reader) (stubStanza, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return stubStanza{}, err
+	}
+	fields := strings.Fields(strings.TrimPrefix(header, "-> "))
+	if len(fields) == 0 {
+		return stubStanza{}, fmt.Errorf("malformed stanza %q", header)
+	}
+	s := stubStanza{typ: fields[0], args: fields[1:]}
+	// the body ends with its first line shorter than 64 columns
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return stubStanza{}, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		s.body += line
+		if len(line) < 64 {
+			return s, nil
+		}
+	}
+}
+
+// runStubPlugin implements an age plugin that stores the file key as is, it only unwraps
+// for the identity holding stubKey
+func runStubPlugin(args []string) int {
+	in := bufio.NewReader(os.Stdin)
+	var stanzas []stubStanza
+	for {
+		s, err := readStubStanza(in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if s.typ == "done" {
+			break
+		}
+		stanzas = append(stanzas, s)
+	}
+	// every reply of the client is an ok stanza
+	send := func(stanza string) {
+		fmt.Fprint(os.Stdout, stanza)
+		if _, err := readStubStanza(in); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	switch strings.Join(args, " ") {
+	case "--age-plugin=recipient-v1":
+		for _, s := range stanzas {
+			if s.typ == "wrap-file-key" {
+				send("-> recipient-stanza 0 stub\n" + s.body + "\n")
+			}
+		}
+	case "--age-plugin=identity-v1":
+		authorized := false
+		for _, s := range stanzas {
+			if s.typ == "add-identity" {
+				_, data, err := plugin.ParseIdentity(s.args[0])
+				authorized = err == nil && bytes.Equal(data, stubKey)
+			}
+		}
+		for _, s := range stanzas {
+			if authorized && s.typ == "recipient-stanza" && len(s.args) > 1 && s.args[1] == "stub" {
+				send("-> msg\n" + base64.RawStdEncoding.EncodeToString([]byte("unwrapping")) + "\n")
+				send("-> file-key 0\n" + s.body + "\n")
+				break
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported arguments %q\n", args)
+		return 1
+	}
+	fmt.Fprint(os.Stdout, "-> done\n\n")
+	return 0
+}
+
+// installStubPlugin puts an age-plugin-stub binary running this test binary on PATH
+func installStubPlugin(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub plugin is a shell script")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\n%s=1 exec %q \"$@\"\n", stubPluginEnv, exe)
+	if err := os.WriteFile(filepath.Join(dir, "age-plugin-stub"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPluginRoundTrip(t *testing.T) {
+	installStubPlugin(t)
+	recipient := plugin.EncodeRecipient("stub", []byte("stub-recipient"))
+	if !isPluginRecipient(recipient) {
+		t.Fatalf("%s is not detected as plugin recipient", recipient)
+	}
+
+	dir := t.TempDir()
+	writeIdentity := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		identity := plugin.EncodeIdentity("stub", data)
+		if err := os.WriteFile(path, []byte("# stub plugin\n"+identity+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	recipients, err := StringsToRecipients([]string{recipient})
+	if err != nil {
+		t.Fatalf("parse recipients: %v", err)
+	}
+	encrypted, err := EncryptBytes([]byte("plugin secret"), recipients)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !bytes.Contains(encrypted, []byte("-> stub")) {
+		t.Fatalf("encrypted file has no stanza of the plugin:\n%q", encrypted)
+	}
+
+	var messages []string
+	ui := *PluginUI
+	PluginUI.DisplayMessage = func(name, message string) error {
+		messages = append(messages, name+": "+message)
+		return nil
+	}
+	t.Cleanup(func() { *PluginUI = ui })
+
+	identities, err := LoadAgeIdentities(writeIdentity("key.txt", stubKey))
+	if err != nil {
+		t.Fatalf("load identities: %v", err)
+	}
+	plain, err := DecryptBytes(encrypted, identities)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(plain) != "plugin secret" {
+		t.Fatalf("decrypted %q, want %q", plain, "plugin secret")
+	}
+	if len(messages) != 1 || messages[0] != "stub: unwrapping" {
+		t.Fatalf("plugin messages = %q, want the message of the stub", messages)
+	}
+
+	other, err := LoadAgeIdentities(writeIdentity("other.txt", []byte("other-key")))
+	if err != nil {
+		t.Fatalf("load identities: %v", err)
+	}
+	if _, err := DecryptBytes(encrypted, other); err == nil {
+		t.Fatal("decrypted with an identity the plugin rejects")
+	}
+}
@@ -6,22 +6,46 @@ import (
 	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
 )
 
 func StringsToRecipients(strs []string) ([]age.Recipient, error) {
 	var b bytes.Buffer
+	var recips []age.Recipient
 	for _, s := range strs {
 		s = strings.TrimSpace(s)
 		if s == "" {
 			continue
 		}
+		// ssh public keys are parsed one by one, keeping their comment
+		if strings.HasPrefix(s, "ssh-") {
+			r, err := agessh.ParseRecipient(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse ssh recipient: %w", err)
+			}
+			recips = append(recips, r)
+			continue
+		}
+		// plugin recipients are handed to the age-plugin-<name> binary
+		if isPluginRecipient(s) {
+			r, err := plugin.NewRecipient(s, PluginUI)
+			if err != nil {
+				return nil, fmt.Errorf("parse plugin recipient: %w", err)
+			}
+			recips = append(recips, r)
+			continue
+		}
 		// age.ParseRecipients accepts multiple lines...
 		b.WriteString(s)
 		b.WriteByte('\n')
 	}
-	recips, err := age.ParseRecipients(&b)
+	if b.Len() == 0 && len(recips) > 0 {
+		return recips, nil
+	}
+	native, err := age.ParseRecipients(&b)
 	if err != nil {
 		return nil, fmt.Errorf("parse recipients: %w", err)
 	}
-	return recips, nil
+	return append(native, recips...), nil
 }
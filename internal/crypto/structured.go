@@ -0,0 +1,506 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the document format of a structured secret file
+type Format string
+
+const (
+	FormatDotenv Format = "dotenv"
+	FormatYAML   Format = "yaml"
+	FormatJSON   Format = "json"
+)
+
+// MACKey is the key holding the HMAC over all keys and plaintext values and its encrypted key
+const MACKey = "nox_mac"
+
+// macKeySize is the size of the random HMAC key of a document
+const macKeySize = 32
+
+var (
+	encValueRe = regexp.MustCompile(`^ENC\[age,data:([A-Za-z0-9+/=]+)(?:,type:(\w+))?(?:,mac:([0-9a-f]+))?\]$`)
+	dotenvRe   = regexp.MustCompile(`^(\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*=)(.*)$`)
+)
+
+// FormatFromPath derives the structured format from a file extension,
+// ignoring a trailing .age extension
+func FormatFromPath(path string) (Format, error) {
+	path = strings.TrimSuffix(path, ".age")
+	base := filepath.Base(path)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	case ".env":
+		return FormatDotenv, nil
+	}
+	if strings.HasPrefix(base, ".env") || strings.HasSuffix(base, ".env") {
+		return FormatDotenv, nil
+	}
+	return "", fmt.Errorf("cannot derive structured format from %q", path)
+}
+
+// ParseFormat validates a format name given on the command line
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatDotenv, FormatYAML, FormatJSON:
+		return f, nil
+	case "env":
+		return FormatDotenv, nil
+	case "yml":
+		return FormatYAML, nil
+	}
+	return "", fmt.Errorf("unknown structured format %q", s)
+}
+
+// DetectStructured reports whether data is a structured encrypted document and its format
+func DetectStructured(data []byte) (Format, bool) {
+	if !bytes.Contains(data, []byte("ENC[age,data:")) {
+		return "", false
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(data, []byte(`"`+MACKey+`"`)) {
+		return FormatJSON, true
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, MACKey+"="):
+			return FormatDotenv, true
+		case strings.HasPrefix(line, MACKey+":"):
+			return FormatYAML, true
+		}
+	}
+	return "", false
+}
+
+// DecryptAuto decrypts structured documents value by value and everything else as a plain age file
+func DecryptAuto(data []byte, identities []age.Identity) ([]byte, error) {
+	if format, ok := DetectStructured(data); ok {
+		return DecryptStructured(data, format, identities)
+	}
+	return DecryptBytes(data, identities)
+}
+
+// ReencryptAuto decrypts data with the given identities and encrypts it again to the given
+// recipients, keeping structured documents structured and armored files armored
+func ReencryptAuto(data []byte, identities []age.Identity, recipients []age.Recipient) ([]byte, error) {
+	return EditAuto(data, identities, recipients, func(plaintext []byte) ([]byte, error) {
+		return plaintext, nil
+	})
+}
+
+// EditAuto decrypts data, applies edit to the plaintext and encrypts the result to recipients,
+// keeping the structured or armored form of the original
+func EditAuto(data []byte, identities []age.Identity, recipients []age.Recipient, edit func([]byte) ([]byte, error)) ([]byte, error) {
+	if format, ok := DetectStructured(data); ok {
+		plaintext, err := DecryptStructured(data, format, identities)
+		if err != nil {
+			return nil, err
+		}
+		if plaintext, err = edit(plaintext); err != nil {
+			return nil, err
+		}
+		return EncryptStructured(plaintext, format, recipients)
+	}
+	plaintext, err := DecryptBytes(data, identities)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext, err = edit(plaintext); err != nil {
+		return nil, err
+	}
+	if IsArmored(data) {
+		return EncryptBytesArmored(plaintext, recipients)
+	}
+	return EncryptBytes(plaintext, recipients)
+}
+
+// EncryptStructured encrypts every value of a dotenv, YAML or JSON document
+// individually while keeping the keys and layout readable
+func EncryptStructured(data []byte, format Format, recipients []age.Recipient) ([]byte, error) {
+	s := &structuredCipher{encrypt: true, recipients: recipients}
+	return s.run(data, format)
+}
+
+// DecryptStructured decrypts every value of a structured document and verifies its MAC
+func DecryptStructured(data []byte, format Format, identities []age.Identity) ([]byte, error) {
+	s := &structuredCipher{identities: identities}
+	return s.run(data, format)
+}
+
+// structuredCipher walks a document and transforms its values in place.
+// The MAC is an HMAC-SHA256 over all paths and plaintext values in document order, keyed with
+// a random key per document that is stored age-encrypted next to it. Without the identities
+// the key cannot be recovered, so values cannot be swapped, dropped or reordered unnoticed.
+type structuredCipher struct {
+	encrypt    bool
+	recipients []age.Recipient
+	identities []age.Identity
+	// macInput collects the paths and plaintext values, the key is only known once the
+	// stored MAC was read when decrypting
+	macInput  bytes.Buffer
+	storedMAC string
+}
+
+func (s *structuredCipher) run(data []byte, format Format) ([]byte, error) {
+	switch format {
+	case FormatDotenv:
+		return s.dotenv(data)
+	case FormatYAML:
+		return s.yaml(data)
+	case FormatJSON:
+		return s.json(data)
+	}
+	return nil, fmt.Errorf("unknown structured format %q", format)
+}
+
+func (s *structuredCipher) digest(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(s.macInput.Bytes())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// value encrypts or decrypts a single value and feeds its plaintext into the MAC
+func (s *structuredCipher) value(path, value, typ string) (string, string, error) {
+	if s.encrypt {
+		s.addMAC(path, value)
+		enc, err := s.seal(value, typ)
+		return enc, "", err
+	}
+	plain, typ, err := s.open(value)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	s.addMAC(path, plain)
+	return plain, typ, nil
+}
+
+func (s *structuredCipher) addMAC(path, value string) {
+	fmt.Fprintf(&s.macInput, "%s\x00%s\x00", path, value)
+}
+
+func (s *structuredCipher) seal(value, typ string) (string, error) {
+	ct, err := EncryptBytes([]byte(value), s.recipients)
+	if err != nil {
+		return "", err
+	}
+	enc := "ENC[age,data:" + base64.StdEncoding.EncodeToString(ct)
+	if typ != "" {
+		enc += ",type:" + typ
+	}
+	return enc + "]", nil
+}
+
+// open decrypts an ENC[...] value, values that are not encrypted are returned as is
+func (s *structuredCipher) open(value string) (string, string, error) {
+	m := encValueRe.FindStringSubmatch(value)
+	if m == nil {
+		return value, "", nil
+	}
+	ct, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	plain, err := DecryptBytes(ct, s.identities)
+	if err != nil {
+		return "", "", err
+	}
+	return string(plain), m[2], nil
+}
+
+// sealMAC returns the MAC with its encrypted key when encrypting, or verifies the stored one when decrypting
+func (s *structuredCipher) sealMAC() (string, error) {
+	if s.encrypt {
+		key := make([]byte, macKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return "", fmt.Errorf("generate MAC key: %w", err)
+		}
+		ct, err := EncryptBytes(key, s.recipients)
+		if err != nil {
+			return "", err
+		}
+		return "ENC[age,data:" + base64.StdEncoding.EncodeToString(ct) + ",mac:" + s.digest(key) + "]", nil
+	}
+	if s.storedMAC == "" {
+		return "", fmt.Errorf("document has no %s", MACKey)
+	}
+	m := encValueRe.FindStringSubmatch(s.storedMAC)
+	if m == nil || m[3] == "" {
+		return "", fmt.Errorf("%s is not a keyed MAC", MACKey)
+	}
+	ct, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid encrypted key: %w", MACKey, err)
+	}
+	key, err := DecryptBytes(ct, s.identities)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", MACKey, err)
+	}
+	if len(key) != macKeySize || !hmac.Equal([]byte(m[3]), []byte(s.digest(key))) {
+		return "", fmt.Errorf("MAC mismatch: document was modified")
+	}
+	return "", nil
+}
+
+func (s *structuredCipher) dotenv(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := dotenvRe.FindStringSubmatch(line)
+		if m == nil {
+			out.WriteString(line + "\n")
+			continue
+		}
+		if m[2] == MACKey {
+			s.storedMAC = m[3]
+			continue
+		}
+		value, _, err := s.value(m[2], m[3], "")
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(m[1] + value + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	mac, err := s.sealMAC()
+	if err != nil {
+		return nil, err
+	}
+	if mac != "" {
+		out.WriteString(MACKey + "=" + mac + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+func (s *structuredCipher) yaml(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse yaml: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("structured yaml must be a mapping")
+	}
+	root := doc.Content[0]
+
+	// detach the stored MAC before walking the document
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == MACKey {
+			s.storedMAC = root.Content[i+1].Value
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			break
+		}
+	}
+	if err := s.yamlNode(root, ""); err != nil {
+		return nil, err
+	}
+	mac, err := s.sealMAC()
+	if err != nil {
+		return nil, err
+	}
+	if mac != "" {
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: MACKey},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: mac})
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (s *structuredCipher) yamlNode(node *yaml.Node, path string) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := s.yamlNode(node.Content[i+1], path+"."+node.Content[i].Value); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			if err := s.yamlNode(item, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value, typ, err := s.value(path, node.Value, strings.TrimPrefix(node.ShortTag(), "!!"))
+		if err != nil {
+			return err
+		}
+		node.Value = value
+		node.Style = 0
+		if s.encrypt {
+			node.Tag = "!!str"
+		} else {
+			if typ != "" {
+				node.Tag = "!!" + typ
+			}
+			if strings.Contains(value, "\n") {
+				node.Style = yaml.LiteralStyle
+			}
+		}
+	}
+	return nil
+}
+
+func (s *structuredCipher) json(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var out bytes.Buffer
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("parse json: %w", err)
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("structured json must be an object")
+	}
+	out.WriteByte('{')
+	first := true
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("parse json: %w", err)
+		}
+		key := keyTok.(string)
+		if key == MACKey {
+			if err := dec.Decode(&s.storedMAC); err != nil {
+				return nil, fmt.Errorf("parse json: %w", err)
+			}
+			continue
+		}
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		writeJSONString(&out, key)
+		out.WriteByte(':')
+		if err := s.jsonValue(dec, &out, "."+key); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("parse json: %w", err)
+	}
+	mac, err := s.sealMAC()
+	if err != nil {
+		return nil, err
+	}
+	if mac != "" {
+		if !first {
+			out.WriteByte(',')
+		}
+		writeJSONString(&out, MACKey)
+		out.WriteByte(':')
+		writeJSONString(&out, mac)
+	}
+	out.WriteByte('}')
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, out.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+func (s *structuredCipher) jsonValue(dec *json.Decoder, out *bytes.Buffer, path string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("parse json: %w", err)
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			out.WriteByte('{')
+			for i := 0; dec.More(); i++ {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return fmt.Errorf("parse json: %w", err)
+				}
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				writeJSONString(out, keyTok.(string))
+				out.WriteByte(':')
+				if err := s.jsonValue(dec, out, path+"."+keyTok.(string)); err != nil {
+					return err
+				}
+			}
+			out.WriteByte('}')
+		} else {
+			out.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				if err := s.jsonValue(dec, out, path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+			out.WriteByte(']')
+		}
+		// consume closing delimiter
+		_, err := dec.Token()
+		return err
+	case string:
+		return s.jsonScalar(out, path, t, "str")
+	case json.Number:
+		return s.jsonScalar(out, path, t.String(), "number")
+	case bool:
+		return s.jsonScalar(out, path, strconv.FormatBool(t), "bool")
+	case nil:
+		return s.jsonScalar(out, path, "null", "null")
+	}
+	return fmt.Errorf("unexpected json token %v", tok)
+}
+
+func (s *structuredCipher) jsonScalar(out *bytes.Buffer, path, value, typ string) error {
+	value, origType, err := s.value(path, value, typ)
+	if err != nil {
+		return err
+	}
+	if s.encrypt || origType == "" || origType == "str" {
+		writeJSONString(out, value)
+		return nil
+	}
+	// numbers, booleans and null are restored verbatim
+	out.WriteString(value)
+	return nil
+}
+
+func writeJSONString(out *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	out.Write(b)
+}
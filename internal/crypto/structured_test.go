@@ -0,0 +1,193 @@
+package crypto
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+func testIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func encryptStructured(t *testing.T, id *age.X25519Identity, plain string, format Format) string {
+	t.Helper()
+	enc, err := EncryptStructured([]byte(plain), format, []age.Recipient{id.Recipient()})
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return string(enc)
+}
+
+func TestStructuredRoundTrip(t *testing.T) {
+	id := testIdentity(t)
+	tests := []struct {
+		name   string
+		format Format
+		plain  string
+		// decode parses a document for comparison, nil compares the text
+		decode func([]byte) (any, error)
+	}{
+		{
+			name:   "dotenv",
+			format: FormatDotenv,
+			plain:  "# database\nDB_HOST=localhost\nexport DB_PASS=s3cr3t=x\n\nEMPTY=\nQUOTED=\"a b\"\n",
+		},
+		{
+			name:   "yaml",
+			format: FormatYAML,
+			plain: `db:
+  host: localhost
+  port: 5432
+  ratio: 0.5
+  tls: true
+  replica: null
+  version: "5432"
+hosts:
+  - a.example.com
+  - b.example.com
+cert: |
+  line one
+  line two
+`,
+			decode: func(data []byte) (any, error) {
+				var v any
+				err := yaml.Unmarshal(data, &v)
+				return v, err
+			},
+		},
+		{
+			name:   "json",
+			format: FormatJSON,
+			plain:  `{"db":{"host":"localhost","port":5432,"ratio":0.5,"tls":true,"replica":null,"version":"5432"},"hosts":["a","b"],"big":12345678901234567890}`,
+			decode: func(data []byte) (any, error) {
+				var v any
+				dec := json.NewDecoder(strings.NewReader(string(data)))
+				dec.UseNumber()
+				err := dec.Decode(&v)
+				return v, err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := encryptStructured(t, id, tt.plain, tt.format)
+			for _, secret := range []string{"localhost", "s3cr3t", "5432", "line one"} {
+				if strings.Contains(enc, secret) {
+					t.Fatalf("encrypted document contains %q:\n%s", secret, enc)
+				}
+			}
+			if format, ok := DetectStructured([]byte(enc)); !ok || format != tt.format {
+				t.Fatalf("DetectStructured = %q, %v, want %q", format, ok, tt.format)
+			}
+
+			dec, err := DecryptStructured([]byte(enc), tt.format, []age.Identity{id})
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if tt.decode == nil {
+				if string(dec) != tt.plain {
+					t.Fatalf("decrypted document differs\ngot:\n%s\nwant:\n%s", dec, tt.plain)
+				}
+				return
+			}
+			got, err := tt.decode(dec)
+			if err != nil {
+				t.Fatalf("parse decrypted document: %v\n%s", err, dec)
+			}
+			want, err := tt.decode([]byte(tt.plain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("decrypted document differs\ngot:  %#v\nwant: %#v", got, want)
+			}
+		})
+	}
+}
+
+// encLineRe matches a dotenv line holding an encrypted value
+var encLineRe = regexp.MustCompile(`(?m)^([A-Z_]+)=(ENC\[[^\]]*\])$`)
+
+func TestStructuredVerify(t *testing.T) {
+	id := testIdentity(t)
+	identities := []age.Identity{id}
+	env := encryptStructured(t, id, "A=1\nB=2\nC=3\n", FormatDotenv)
+	values := make(map[string]string)
+	for _, m := range encLineRe.FindAllStringSubmatch(env, -1) {
+		values[m[1]] = m[2]
+	}
+
+	tests := []struct {
+		name   string
+		format Format
+		doc    string
+		err    string
+	}{
+		{
+			name:   "swapped values",
+			format: FormatDotenv,
+			doc: strings.NewReplacer("A="+values["A"], "A="+values["B"], "B="+values["B"], "B="+values["A"]).
+				Replace(env),
+			err: "MAC mismatch",
+		},
+		{
+			name:   "dropped value",
+			format: FormatDotenv,
+			doc:    strings.Replace(env, "B="+values["B"]+"\n", "", 1),
+			err:    "MAC mismatch",
+		},
+		{
+			name:   "added value",
+			format: FormatDotenv,
+			doc:    "D=" + values["A"] + "\n" + env,
+			err:    "MAC mismatch",
+		},
+		{
+			name:   "added plaintext value",
+			format: FormatDotenv,
+			doc:    "D=4\n" + env,
+			err:    "MAC mismatch",
+		},
+		{
+			name:   "dotenv without mac",
+			format: FormatDotenv,
+			doc:    regexp.MustCompile(`(?m)^`+MACKey+`=.*\n`).ReplaceAllString(env, ""),
+			err:    "has no " + MACKey,
+		},
+		{
+			name:   "yaml without mac",
+			format: FormatYAML,
+			doc:    regexp.MustCompile(`(?m)^`+MACKey+`:.*\n`).ReplaceAllString(encryptStructured(t, id, "a: 1\n", FormatYAML), ""),
+			err:    "has no " + MACKey,
+		},
+		{
+			name:   "json without mac",
+			format: FormatJSON,
+			doc:    regexp.MustCompile(`,\s*"`+MACKey+`": "[^"]*"`).ReplaceAllString(encryptStructured(t, id, `{"a":1}`, FormatJSON), ""),
+			err:    "has no " + MACKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecryptStructured([]byte(tt.doc), tt.format, identities)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("decrypt error = %v, want %q\n%s", err, tt.err, tt.doc)
+			}
+		})
+	}
+
+	if _, err := DecryptStructured([]byte(env), FormatDotenv, identities); err != nil {
+		t.Fatalf("untampered document: %v", err)
+	}
+}
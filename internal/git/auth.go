@@ -1,13 +1,18 @@
 package git
 
 import (
+	"errors"
 	"os"
+	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 )
 
+// ErrAuthSetup is returned when the configured git credentials cannot be loaded
+var ErrAuthSetup = errors.New("failed to set up git auth")
+
 func GetAuth() (transport.AuthMethod, error) {
 
 	if sshKey, exists := os.LookupEnv("NOX_GIT_SSH_KEY_FILE"); exists {
@@ -36,3 +41,18 @@ func GetAuth() (transport.AuthMethod, error) {
 	}
 	return nil, nil
 }
+
+// IsAuthError reports whether err was caused by missing, unreadable or rejected git credentials
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrAuthSetup) ||
+		errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed) ||
+		errors.Is(err, transport.ErrInvalidAuthMethod) {
+		return true
+	}
+	// ssh handshake failures are not exposed as typed errors
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
@@ -0,0 +1,65 @@
+package git
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// historyDepth deepens a shallow clone to its full history, like the infinite depth of git
+const historyDepth = 1<<31 - 1
+
+// FetchHistory fetches the full history of all branches of origin into the shallow clone
+func (r *ClonedRepo) FetchHistory() error {
+	auth, err := GetAuth()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthSetup, err)
+	}
+	err = r.Repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []gitconfig.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+		Depth:      historyDepth,
+		Tags:       git.AllTags,
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("fetch history: %w", err)
+	}
+	return nil
+}
+
+// CommitAt resolves a revision like HEAD~2, a branch, tag or commit hash to its commit
+func (r *ClonedRepo) CommitAt(rev string) (*object.Commit, error) {
+	hash, err := r.Repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("unknown revision %s: %w", rev, err)
+	}
+	commit, err := r.Repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit %s: %w", rev, err)
+	}
+	return commit, nil
+}
+
+// FileHistory returns the commits reachable from the branch head that changed path, newest first
+func (r *ClonedRepo) FileHistory(path string) ([]*object.Commit, error) {
+	iter, err := r.Repo.Log(&git.LogOptions{From: r.Ref.Hash(), FileName: &path})
+	if err != nil {
+		return nil, fmt.Errorf("log %s: %w", path, err)
+	}
+	defer iter.Close()
+
+	var commits []*object.Commit
+	err = iter.ForEach(func(c *object.Commit) error {
+		commits = append(commits, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("log %s: %w", path, err)
+	}
+	return commits, nil
+}
@@ -23,7 +23,7 @@ func CloneRepo(c config.GitConfig) (*ClonedRepo, error) {
 
 	auth, err := GetAuth()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrAuthSetup, err)
 	}
 
 	cloneOpts := &git.CloneOptions{
@@ -61,6 +61,20 @@ func CloneRepo(c config.GitConfig) (*ClonedRepo, error) {
 	}, nil
 }
 
+// OpenFileFromTree returns a reader streaming the content of a file in the tree
+func OpenFileFromTree(tree *object.Tree, path string) (io.ReadCloser, error) {
+	file, err := tree.File(path)
+	if err != nil {
+		return nil, fmt.Errorf("file %q not found: %w", path, err)
+	}
+
+	reader, err := file.Blob.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reader for %q: %w", path, err)
+	}
+	return reader, nil
+}
+
 func GetFileContentFromTree(tree *object.Tree, path string) ([]byte, error) {
 	file, err := tree.File(path)
 	if err != nil {
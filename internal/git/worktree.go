@@ -0,0 +1,62 @@
+package git
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// CommitFiles stages the given paths, relative to the root of the working copy in dir,
+// and commits them using the author configured for the repository
+func CommitFiles(dir string, paths []string, message string) (string, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", fmt.Errorf("open working copy %s: %w", dir, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("get worktree: %w", err)
+	}
+	for _, p := range paths {
+		if _, err := wt.Add(p); err != nil {
+			return "", fmt.Errorf("stage %s: %w", p, err)
+		}
+	}
+	hash, err := wt.Commit(message, &git.CommitOptions{})
+	if err != nil {
+		return "", fmt.Errorf("commit: %w", err)
+	}
+	return hash.String(), nil
+}
+
+// Push pushes the current branch of the working copy in dir to origin
+func Push(dir string) error {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return fmt.Errorf("open working copy %s: %w", dir, err)
+	}
+	auth, err := GetAuth()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAuthSetup, err)
+	}
+	if err := repo.Push(&git.PushOptions{RemoteName: "origin", Auth: auth}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("push: %w", err)
+	}
+	return nil
+}
+
+// CurrentBranch returns the branch checked out in the working copy in dir, empty for a detached HEAD
+func CurrentBranch(dir string) (string, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", fmt.Errorf("open working copy %s: %w", dir, err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("resolve HEAD of %s: %w", dir, err)
+	}
+	if !head.Name().IsBranch() {
+		return "", nil
+	}
+	return head.Name().Short(), nil
+}
@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"io"
 	"log/slog"
 	"os"
 	"strings"
@@ -13,8 +14,28 @@ var (
 	once     sync.Once
 	logger   *slog.Logger
 	logLevel = &slog.LevelVar{}
+	output   = &outputWriter{w: os.Stdout}
 )
 
+// outputWriter lets the destination of the logger change after it was created
+type outputWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.w.Write(p)
+}
+
+// SetOutput sends the log to w, for example to STDERR when STDOUT carries data
+func SetOutput(w io.Writer) {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	output.w = w
+}
+
 func Get() Logger {
 	Init()
 	return logger
@@ -23,7 +44,7 @@ func Get() Logger {
 func InitTextLogger() {
 	once.Do(func() {
 		logLevel.Set(slog.LevelInfo)
-		h := NewCliHandler(os.Stdout, logLevel)
+		h := NewCliHandler(output, logLevel)
 		logger = slog.New(h)
 	})
 }
@@ -31,7 +52,7 @@ func InitTextLogger() {
 func Init() {
 	once.Do(func() {
 		logLevel.Set(slog.LevelInfo)
-		h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})
+		h := slog.NewJSONHandler(output, &slog.HandlerOptions{Level: slog.LevelError})
 		logger = slog.New(h)
 	})
 }
@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/git"
+	"github.com/aottr/nox/internal/logging"
+)
+
+type AddOptions struct {
+	ConfigPath string
+	App        string
+	// Input is the plaintext file to add
+	Input string
+	// RepoDir is the root of a local working copy of the app's repository
+	RepoDir string
+	// RepoPath is the path of the encrypted file in the repository, by default Input with .age appended
+	RepoPath   string
+	Output     string
+	Structured bool
+	Commit     bool
+	Push       bool
+	Message    string
+}
+
+// AddSecret encrypts a plaintext file to the recipients of an app, writes it into a working
+// copy of the repository and registers it for the app in the config file
+func AddSecret(cfg *config.Config, opts AddOptions) error {
+	log := logging.Get()
+
+	repoPath := opts.RepoPath
+	if repoPath == "" {
+		repoPath = path.Clean(filepath.ToSlash(opts.Input)) + ".age"
+	}
+	if path.IsAbs(repoPath) || strings.HasPrefix(repoPath, "../") {
+		return fmt.Errorf("%s is outside of the repository, set the repository path explicitly", repoPath)
+	}
+
+	keys, err := cfg.RecipientsFor(opts.App, &config.FileConfig{Path: repoPath})
+	if err != nil {
+		return err
+	}
+	recipients, err := crypto.StringsToRecipients(keys)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(opts.RepoDir, filepath.FromSlash(repoPath))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %w", target, err)
+	}
+	if opts.Structured {
+		format, err := crypto.FormatFromPath(opts.Input)
+		if err != nil {
+			return err
+		}
+		err = IOWrapper(opts.Input, target, recipients, func(data []byte, r []age.Recipient) ([]byte, error) {
+			return crypto.EncryptStructured(data, format, r)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		err = StreamWrapper(opts.Input, target, func(dst io.Writer, src io.Reader) error {
+			return crypto.EncryptStream(dst, src, recipients, false)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := crypto.WriteRecipientsManifest(target, keys); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("encrypted %s to %s", opts.Input, target))
+
+	// apps defined in an included file are registered there
+	configPath := cfg.AppFile(opts.App)
+	if configPath == "" {
+		configPath = opts.ConfigPath
+	}
+	added, err := config.AddFile(configPath, opts.App, config.FileConfig{Path: repoPath, Output: configRelative(configPath, opts.Output)})
+	if err != nil {
+		return fmt.Errorf("failed to register %s in %s: %w", repoPath, configPath, err)
+	}
+	if added {
+		log.Info(fmt.Sprintf("registered %s for app %s in %s", repoPath, opts.App, configPath))
+	}
+
+	if !opts.Commit && !opts.Push {
+		return nil
+	}
+	message := opts.Message
+	if message == "" {
+		message = fmt.Sprintf("Add %s for %s", repoPath, opts.App)
+	}
+	hash, err := git.CommitFiles(opts.RepoDir, []string{repoPath, crypto.ManifestPath(repoPath)}, message)
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("committed %s", hash))
+	if opts.Push {
+		if err := git.Push(opts.RepoDir); err != nil {
+			return err
+		}
+		log.Info("pushed to origin")
+	}
+	return nil
+}
+
+// configRelative rewrites a path relative to the working directory to be relative to the directory
+// of the config file, where relative paths of the config are resolved
+func configRelative(configPath, path string) string {
+	dir := filepath.Dir(configPath)
+	if path == "" || filepath.IsAbs(path) || samePath(dir, ".") {
+		return path
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return path
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return path
+	}
+	return rel
+}
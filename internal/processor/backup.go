@@ -0,0 +1,232 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/constants"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/logging"
+	"github.com/aottr/nox/internal/state"
+)
+
+// backupTimeFormat sorts lexically in chronological order
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// backupDir returns the directory holding the backups of one file of an app
+func backupDir(policy *config.BackupConfig, appName string, file config.FileConfig) string {
+	dir := policy.Dir
+	if dir == "" {
+		dir = constants.DefaultBackupDir
+	}
+	return filepath.Join(dir, url.PathEscape(appName), url.PathEscape(file.Path))
+}
+
+// backupPolicy returns the backup policy of an app, nil if backups are disabled
+func backupPolicy(cfg *config.Config, appName string) *config.BackupConfig {
+	policy := cfg.Apps[appName].Backup
+	if policy == nil || policy.Keep <= 0 {
+		return nil
+	}
+	return policy
+}
+
+// backupRecipients returns the configured backup recipients, or the recipients of the X25519 identities
+func backupRecipients(cfg *config.Config, policy *config.BackupConfig, identities []age.Identity) ([]age.Recipient, error) {
+	if len(policy.Recipients) > 0 {
+		keys, err := cfg.ResolveRecipients(policy.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.StringsToRecipients(keys)
+	}
+	var recipients []age.Recipient
+	for _, id := range identities {
+		if x, ok := id.(*age.X25519Identity); ok {
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("backup needs recipients, none configured and no X25519 identity loaded")
+	}
+	return recipients, nil
+}
+
+// backupOutput encrypts the current output of a file into its backup directory before it is
+// overwritten. An output equal to the newest backup is not backed up again.
+func backupOutput(ctx *config.RuntimeContext, appName string, file config.FileConfig) error {
+	policy := backupPolicy(ctx.Config, appName)
+	if policy == nil {
+		return nil
+	}
+	src, err := os.Open(file.OutputPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	recipients, err := backupRecipients(ctx.Config, policy, ctx.Identities)
+	if err != nil {
+		return err
+	}
+	dir := backupDir(policy, appName, file)
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 && sameAsBackup(file.OutputPath(), backups[0], ctx.Identities) {
+		logging.Get().Debug(fmt.Sprintf("%s is unchanged since its last backup", file.OutputPath()))
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create backup directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, time.Now().UTC().Format(backupTimeFormat)+".age")
+	err = writeFileAtomic(path, 0600, func(w io.Writer) error {
+		return crypto.EncryptStream(w, src, recipients, false)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to back up %s: %w", file.OutputPath(), err)
+	}
+	logging.Get().Debug(fmt.Sprintf("backed up %s to %s", file.OutputPath(), path))
+	return nil
+}
+
+// sameAsBackup reports whether the file at path has the content of the backup. A backup the
+// identities cannot decrypt counts as different.
+func sameAsBackup(path, backup string, identities []age.Identity) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	current, err := state.HashReader(f)
+	if err != nil {
+		return false
+	}
+
+	b, err := os.Open(backup)
+	if err != nil {
+		return false
+	}
+	defer b.Close()
+	h := sha256.New()
+	if err := crypto.DecryptStream(h, b, identities); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == current
+}
+
+// pruneBackups drops the backups of a file exceeding the retention of the app
+func pruneBackups(ctx *config.RuntimeContext, appName string, file config.FileConfig) error {
+	policy := backupPolicy(ctx.Config, appName)
+	if policy == nil {
+		return nil
+	}
+	backups, err := listBackups(backupDir(policy, appName, file))
+	if err != nil {
+		return err
+	}
+	for _, old := range backups[min(len(backups), policy.Keep):] {
+		if err := os.Remove(old); err != nil {
+			return fmt.Errorf("failed to prune backup %s: %w", old, err)
+		}
+	}
+	return nil
+}
+
+// listBackups returns the backups in dir, newest first
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".age") {
+			backups = append(backups, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// appBackups returns the file of the context's app matching path, by repository or output path, and its backups
+func appBackups(ctx *config.RuntimeContext, path string) (config.FileConfig, []string, error) {
+	policy := backupPolicy(ctx.Config, ctx.App)
+	if policy == nil {
+		return config.FileConfig{}, nil, fmt.Errorf("app %s has no backup policy", ctx.App)
+	}
+	for _, file := range ctx.Config.Apps[ctx.App].Files {
+		if file.Path != path && !samePath(file.OutputPath(), path) {
+			continue
+		}
+		backups, err := listBackups(backupDir(policy, ctx.App, file))
+		return file, backups, err
+	}
+	return config.FileConfig{}, nil, fmt.Errorf("app %s has no file %s", ctx.App, path)
+}
+
+// ListBackups writes the numbered backups of a file of the context's app, 1 being the newest
+func ListBackups(ctx *config.RuntimeContext, path string, w io.Writer) error {
+	file, backups, err := appBackups(ctx, path)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		fmt.Fprintf(w, "no backups of %s\n", file.OutputPath())
+		return nil
+	}
+	for i, b := range backups {
+		when := strings.TrimSuffix(filepath.Base(b), ".age")
+		if t, err := time.Parse(backupTimeFormat, when); err == nil {
+			when = t.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%d  %s\n", i+1, when)
+	}
+	return nil
+}
+
+// RestoreBackup decrypts backup version of a file of the context's app, 1 being the newest,
+// into its output. The current output is backed up before it is replaced, so a restore can be undone.
+func RestoreBackup(ctx *config.RuntimeContext, path string, version int) error {
+	file, backups, err := appBackups(ctx, path)
+	if err != nil {
+		return err
+	}
+	if version < 1 || version > len(backups) {
+		return fmt.Errorf("%s has %d backups, version %d does not exist", file.OutputPath(), len(backups), version)
+	}
+	src, err := os.Open(backups[version-1])
+	if err != nil {
+		return err
+	}
+	err = writeOutput(file, func(w io.Writer) error {
+		return crypto.DecryptStream(w, src, ctx.Identities)
+	}, func() error {
+		return backupOutput(ctx, ctx.App, file)
+	})
+	src.Close()
+	if err != nil {
+		return err
+	}
+	logging.Get().Info(fmt.Sprintf("restored %s from %s", file.OutputPath(), backups[version-1]))
+	// the restored backup may exceed the retention now, it is pruned only once it is closed
+	return pruneBackups(ctx, ctx.App, file)
+}
@@ -0,0 +1,280 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aottr/nox/internal/cache"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/git"
+	"gopkg.in/yaml.v3"
+)
+
+// maskLength is the number of hex digits of the hash that masks a value
+const maskLength = 8
+
+// maskKeyFile keys the hashes masking values so short secrets cannot be guessed from a diff,
+// it is created in the user config directory so two runs of git diff mask values alike
+var maskKeyFile = filepath.Join("nox", "mask.key")
+
+type DiffOptions struct {
+	// Path is the repository path of the secret
+	Path string
+	// From and To are revisions like HEAD~1, a branch, tag or commit hash
+	From       string
+	To         string
+	ShowValues bool
+}
+
+// DiffSecret decrypts a secret at two revisions of the repository of the context's app,
+// or the global repository, and writes a key-level diff to w
+func DiffSecret(ctx *config.RuntimeContext, opts DiffOptions, w io.Writer) error {
+	key := cache.RepoKey{Repo: ctx.Config.GitConfig.Repo, Branch: ctx.Config.GitConfig.Branch}
+	if ctx.App != "" {
+		key = repoKeyForApp(ctx.Config, ctx.App)
+	}
+	repo, err := cache.GlobalCache.GetOrFetch(key)
+	if err != nil {
+		return fmt.Errorf("failed to fetch repo %s: %w", key.Repo, err)
+	}
+	if err := repo.FetchHistory(); err != nil {
+		return err
+	}
+
+	before, err := secretAt(repo, opts.From, opts.Path, ctx.Identities)
+	if err != nil {
+		return err
+	}
+	after, err := secretAt(repo, opts.To, opts.Path, ctx.Identities)
+	if err != nil {
+		return err
+	}
+	if before == nil && after == nil {
+		return fmt.Errorf("%s exists neither at %s nor at %s", opts.Path, opts.From, opts.To)
+	}
+
+	m, err := newMasker(opts.ShowValues)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "--- %s@%s\n+++ %s@%s\n", opts.Path, opts.From, opts.Path, opts.To)
+	writeKeyDiff(w, before, after, opts.Path, m)
+	return nil
+}
+
+// secretAt returns the decrypted content of path at rev, nil if the file does not exist
+func secretAt(repo *git.ClonedRepo, rev, path string, identities []age.Identity) ([]byte, error) {
+	commit, err := repo.CommitAt(rev)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree of %s: %w", rev, err)
+	}
+	if !git.FileExistsInTree(tree, path) {
+		return nil, nil
+	}
+	var out bytes.Buffer
+	if err := decryptTreeFile(tree, path, identities, &out); err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s at %s: %w", path, rev, err)
+	}
+	return out.Bytes(), nil
+}
+
+// writeKeyDiff writes the added, removed and changed keys between two plaintexts
+func writeKeyDiff(w io.Writer, before, after []byte, path string, m *masker) {
+	if bytes.Equal(before, after) {
+		fmt.Fprintln(w, "no changes")
+		return
+	}
+	old, oldErr := flattenSecret(before, path)
+	cur, curErr := flattenSecret(after, path)
+	if oldErr != nil || curErr != nil || (len(old) == 0 && len(cur) == 0) {
+		fmt.Fprintln(w, "~ content differs, no keys could be compared")
+		return
+	}
+
+	keys := make([]string, 0, len(old)+len(cur))
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := 0
+	for _, k := range keys {
+		o, inOld := old[k]
+		c, inCur := cur[k]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "+ %s=%s\n", k, m.mask(k, c))
+		case !inCur:
+			fmt.Fprintf(w, "- %s=%s\n", k, m.mask(k, o))
+		case o != c:
+			fmt.Fprintf(w, "~ %s: %s -> %s\n", k, m.mask(k, o), m.mask(k, c))
+		default:
+			continue
+		}
+		changes++
+	}
+	if changes == 0 {
+		fmt.Fprintln(w, "no key changes, only formatting or comments differ")
+	}
+}
+
+// Textconv writes a decrypted representation of a secret for git diff. By default every value is
+// masked by a hash, so git shows which keys changed without showing the values.
+func Textconv(data []byte, path string, identities []age.Identity, showValues bool, w io.Writer) error {
+	plaintext, err := crypto.DecryptAuto(data, identities)
+	if err != nil {
+		return err
+	}
+	if showValues {
+		_, err := w.Write(plaintext)
+		return err
+	}
+	values, err := flattenSecret(plaintext, path)
+	if err != nil || len(values) == 0 {
+		_, err := fmt.Fprintf(w, "# %d bytes, content masked\n", len(plaintext))
+		return err
+	}
+	m, err := newMasker(false)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", k, m.mask(k, values[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// masker replaces values with a keyed hash of the key and value, equal values of different
+// keys get different hashes. Without a key the values are shown.
+type masker struct {
+	key []byte
+}
+
+func newMasker(showValues bool) (*masker, error) {
+	if showValues {
+		return &masker{}, nil
+	}
+	key, err := loadMaskKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the key masking values: %w", err)
+	}
+	return &masker{key: key}, nil
+}
+
+func (m *masker) mask(key, value string) string {
+	if m.key == nil {
+		return value
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(key))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:maskLength]
+}
+
+// loadMaskKey reads the key masking values, generating it on first use
+func loadMaskKey() ([]byte, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, maskKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) == sha256.Size {
+		return key, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key = make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// flattenSecret maps the keys of a dotenv, YAML or JSON secret to their values. Nested
+// keys are joined with dots, files without a known extension are read as dotenv.
+func flattenSecret(plaintext []byte, path string) (map[string]string, error) {
+	values := make(map[string]string)
+	format, err := crypto.FormatFromPath(path)
+	if err != nil || format == crypto.FormatDotenv {
+		for _, line := range strings.Split(string(plaintext), "\n") {
+			if m := envLineRe.FindStringSubmatch(line); m != nil {
+				values[m[2]] = unquoteEnv(m[3])
+			}
+		}
+		return values, nil
+	}
+
+	// JSON is valid YAML
+	var doc yaml.Node
+	if err := yaml.Unmarshal(plaintext, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) > 0 {
+		flattenNode(doc.Content[0], "", values)
+	}
+	delete(values, crypto.MACKey)
+	return values, nil
+}
+
+func flattenNode(node *yaml.Node, prefix string, values map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			flattenNode(node.Content[i+1], join(node.Content[i].Value), values)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			flattenNode(item, join(strconv.Itoa(i)), values)
+		}
+	case yaml.AliasNode:
+		flattenNode(node.Alias, prefix, values)
+	default:
+		values[prefix] = node.Value
+	}
+}
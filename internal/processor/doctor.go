@@ -0,0 +1,238 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"filippo.io/age"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/constants"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/git"
+	"github.com/aottr/nox/internal/state"
+)
+
+type DoctorOptions struct {
+	ConfigPath     string
+	StatePath      string
+	IdentityPaths  []string
+	PassphraseFile string
+}
+
+// doctor writes the outcome of every check and counts the failed ones
+type doctor struct {
+	w      io.Writer
+	failed int
+}
+
+func (d *doctor) section(name string) {
+	fmt.Fprintf(d.w, "%s\n", name)
+}
+
+func (d *doctor) pass(format string, args ...any) {
+	fmt.Fprintf(d.w, "  ✅ %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(format string, args ...any) {
+	fmt.Fprintf(d.w, "  ⚠️ %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(format string, args ...any) {
+	d.failed++
+	fmt.Fprintf(d.w, "  ❌ %s\n", fmt.Sprintf(format, args...))
+}
+
+// Doctor checks step by step everything a sync depends on, from the config to the state file,
+// and keeps going after a failed check so a single run shows every problem
+func Doctor(opts DoctorOptions, w io.Writer) error {
+	d := &doctor{w: w}
+
+	d.section("config")
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		d.fail("%s does not parse: %v", opts.ConfigPath, err)
+		return fmt.Errorf("❌ the config is required for the remaining checks")
+	}
+	d.pass("%s parses", opts.ConfigPath)
+	if cfg.Environment != "" {
+		d.pass("using environment %s", cfg.Environment)
+	}
+
+	d.section("identities")
+	ids := d.identities(cfg, opts)
+
+	d.section("git")
+	auth, err := git.GetAuth()
+	switch {
+	case err != nil:
+		d.fail("git credentials cannot be loaded: %v", err)
+	case auth == nil:
+		d.pass("no git credentials set, only repositories without authentication are reachable")
+	default:
+		d.pass("authenticating with %s", auth.Name())
+	}
+
+	repos := make(map[config.GitConfig]*git.ClonedRepo)
+	for _, appName := range slices.Sorted(maps.Keys(cfg.Apps)) {
+		app := cfg.Apps[appName]
+		d.section("app " + appName)
+		gitConf := app.GitConfig
+		if !gitConf.IsValid() {
+			gitConf = cfg.GitConfig
+		}
+		repo, cloned := repos[gitConf]
+		if !cloned {
+			repo, err = git.CloneRepo(gitConf)
+			if err != nil {
+				if git.IsAuthError(err) {
+					err = fmt.Errorf("authentication failed: %w", err)
+				}
+				d.fail("branch %s of %s is not reachable: %v", gitConf.Branch, gitConf.Repo, err)
+			}
+			repos[gitConf] = repo
+		}
+		if repo != nil && !cloned {
+			d.pass("branch %s of %s is reachable at %s", gitConf.Branch, gitConf.Repo, shortHash(repo.Ref.Hash().String()))
+		}
+
+		for _, file := range app.Files {
+			switch {
+			case repo == nil:
+				d.warn("%s not checked, the repository is not reachable", file.Path)
+			case !git.FileExistsInTree(repo.Tree, file.Path):
+				d.fail("%s does not exist on branch %s", file.Path, gitConf.Branch)
+			case len(ids) == 0:
+				d.warn("%s exists but is not decrypted, no identity loaded", file.Path)
+			default:
+				if err := decryptTreeFile(repo.Tree, file.Path, ids, io.Discard); err != nil {
+					d.fail("%s does not decrypt: %v", file.Path, err)
+				} else {
+					d.pass("%s exists and decrypts", file.Path)
+				}
+			}
+
+			dir := filepath.Dir(file.OutputPath())
+			if err := checkWritable(dir); err != nil {
+				d.fail("output directory %s is not writable: %v", dir, err)
+			} else {
+				d.pass("output directory %s is writable", dir)
+			}
+		}
+	}
+
+	d.section("state")
+	statePath := opts.StatePath
+	if statePath == "" {
+		statePath = cfg.StatePath
+	}
+	if statePath == "" {
+		statePath = constants.DefaultStatePath
+	}
+	d.state(statePath)
+
+	if d.failed > 0 {
+		return fmt.Errorf("❌ %d checks failed", d.failed)
+	}
+	fmt.Fprintln(w, "all checks passed!")
+	return nil
+}
+
+// identities checks the permissions of every identity file and loads the identities
+func (d *doctor) identities(cfg *config.Config, opts DoctorOptions) []age.Identity {
+	if opts.PassphraseFile != "" {
+		crypto.SetPassphraseFile(opts.PassphraseFile)
+	} else if cfg.Age.PassphraseFile != "" {
+		crypto.SetPassphraseFile(cfg.Age.PassphraseFile)
+	}
+
+	sources := opts.IdentityPaths
+	if len(sources) == 0 {
+		sources = cfg.IdentitySources()
+	}
+	if len(sources) == 0 {
+		d.fail("no age identity configured")
+		return nil
+	}
+
+	var ids []age.Identity
+	for _, source := range sources {
+		if !crypto.IsIdentitySource(source) {
+			info, err := os.Stat(source)
+			if err != nil {
+				d.fail("identity file %s does not exist: %v", source, err)
+				continue
+			}
+			if perm := info.Mode().Perm(); perm&0o077 != 0 {
+				d.fail("identity file %s is accessible by other users (%04o), run chmod 600 %s", source, perm, source)
+			} else {
+				d.pass("identity file %s exists with permissions %04o", source, perm)
+			}
+		}
+		loaded, err := crypto.LoadAgeIdentitiesFromPaths([]string{source})
+		if err != nil {
+			d.fail("%v", err)
+			continue
+		}
+		d.pass("loaded %d identities from %s", len(loaded), source)
+		ids = append(ids, loaded...)
+	}
+	return ids
+}
+
+// state checks that the state file is readable, a missing file is created by the first sync
+func (d *doctor) state(path string) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := checkWritable(filepath.Dir(path)); err != nil {
+			d.fail("state file %s does not exist and cannot be created: %v", path, err)
+			return
+		}
+		d.pass("state file %s does not exist yet, the first sync creates it", path)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		d.fail("state file %s is not readable: %v", path, err)
+		return
+	}
+	f.Close()
+	state.SetPath(path)
+	if _, err := state.Load(); err != nil {
+		d.fail("state file %s is corrupt: %v", path, err)
+		return
+	}
+	d.pass("state file %s is readable", path)
+}
+
+// checkWritable creates and removes a file in dir, or in its closest existing parent
+// if dir does not exist yet since writing an output creates the missing directories
+func checkWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".nox-doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,255 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/git"
+	"github.com/aottr/nox/internal/logging"
+)
+
+type EnvKeyOptions struct {
+	// RepoDir is the root of a local working copy of the secrets repository
+	RepoDir string
+	// File is the repository path of the app file, required if the app has several files
+	File    string
+	Commit  bool
+	Message string
+}
+
+var (
+	envKeyRe    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	envLineRe   = regexp.MustCompile(`^(\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*=)(.*)$`)
+	envBareRe   = regexp.MustCompile(`^[A-Za-z0-9_./:@+,%=-]*$`)
+	envEscaping = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	envUnescape = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+)
+
+// GetEnvKey decrypts the dotenv file of the app and returns the value of key
+func GetEnvKey(ctx *config.RuntimeContext, opts EnvKeyOptions, key string) (string, error) {
+	file, err := appEnvFile(ctx, opts.File)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(opts.RepoDir, file.Path))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := crypto.DecryptAuto(data, ctx.Identities)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", file.Path, err)
+	}
+	value, ok := lookupEnv(plaintext, key)
+	if !ok {
+		return "", fmt.Errorf("%s is not set in %s", key, file.Path)
+	}
+	return value, nil
+}
+
+// SetEnvKey sets key to value in the dotenv file of the app and re-encrypts it
+func SetEnvKey(ctx *config.RuntimeContext, opts EnvKeyOptions, key, value string) error {
+	if !envKeyRe.MatchString(key) {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	message := opts.Message
+	if message == "" {
+		message = fmt.Sprintf("Set %s for %s", key, ctx.App)
+	}
+	return editEnvFile(ctx, opts, message, func(plaintext []byte) ([]byte, error) {
+		return setEnv(plaintext, key, value), nil
+	})
+}
+
+// UnsetEnvKey removes key from the dotenv file of the app and re-encrypts it
+func UnsetEnvKey(ctx *config.RuntimeContext, opts EnvKeyOptions, key string) error {
+	message := opts.Message
+	if message == "" {
+		message = fmt.Sprintf("Unset %s for %s", key, ctx.App)
+	}
+	return editEnvFile(ctx, opts, message, func(plaintext []byte) ([]byte, error) {
+		out, ok := unsetEnv(plaintext, key)
+		if !ok {
+			return nil, fmt.Errorf("%s is not set", key)
+		}
+		return out, nil
+	})
+}
+
+// appEnvFile selects the file of the app to edit
+func appEnvFile(ctx *config.RuntimeContext, path string) (config.FileConfig, error) {
+	app, ok := ctx.Config.Apps[ctx.App]
+	if !ok {
+		return config.FileConfig{}, fmt.Errorf("app %s not found in config", ctx.App)
+	}
+	var file config.FileConfig
+	switch {
+	case path != "":
+		f, ok := app.FindFile(path)
+		if !ok {
+			return config.FileConfig{}, fmt.Errorf("app %s has no file %s", ctx.App, path)
+		}
+		file = *f
+	case len(app.Files) == 1:
+		file = app.Files[0]
+	case len(app.Files) == 0:
+		return config.FileConfig{}, fmt.Errorf("app %s has no files", ctx.App)
+	default:
+		return config.FileConfig{}, fmt.Errorf("app %s has several files, select one with --file", ctx.App)
+	}
+	// files without a recognizable extension are assumed to be dotenv files
+	if format, err := crypto.FormatFromPath(file.Path); err == nil && format != crypto.FormatDotenv {
+		return config.FileConfig{}, fmt.Errorf("%s is not a dotenv file", file.Path)
+	}
+	return file, nil
+}
+
+// editEnvFile re-encrypts the edited dotenv file to its configured recipients and optionally commits it
+func editEnvFile(ctx *config.RuntimeContext, opts EnvKeyOptions, message string, edit func([]byte) ([]byte, error)) error {
+	file, err := appEnvFile(ctx, opts.File)
+	if err != nil {
+		return err
+	}
+	keys, err := ctx.Config.RecipientsFor(ctx.App, &file)
+	if err != nil {
+		return err
+	}
+	recipients, err := crypto.StringsToRecipients(keys)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(opts.RepoDir, file.Path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := crypto.EditAuto(data, ctx.Identities, recipients, edit)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file.Path, err)
+	}
+	err = writeFileAtomic(path, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	changed := []string{file.Path}
+	if _, err := os.Stat(crypto.ManifestPath(path)); err == nil {
+		if err := crypto.WriteRecipientsManifest(path, keys); err != nil {
+			return err
+		}
+		changed = append(changed, crypto.ManifestPath(file.Path))
+	}
+	if !opts.Commit {
+		return nil
+	}
+	hash, err := git.CommitFiles(opts.RepoDir, changed, message)
+	if err != nil {
+		return err
+	}
+	logging.Get().Info(fmt.Sprintf("committed %s", hash))
+	return nil
+}
+
+// lookupEnv returns the unquoted value of key, later assignments win like in a shell
+func lookupEnv(data []byte, key string) (string, bool) {
+	var value string
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if m := envLineRe.FindStringSubmatch(line); m != nil && m[2] == key {
+			value, found = unquoteEnv(m[3]), true
+		}
+	}
+	return value, found
+}
+
+// setEnv replaces the first assignment of key and drops later ones, or appends it
+func setEnv(data []byte, key, value string) []byte {
+	var out bytes.Buffer
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	set := false
+	for _, line := range lines {
+		m := envLineRe.FindStringSubmatch(line)
+		if m == nil || m[2] != key {
+			out.WriteString(line + "\n")
+			continue
+		}
+		if !set {
+			out.WriteString(m[1] + quoteEnv(value) + "\n")
+			set = true
+		}
+	}
+	if !set {
+		out.WriteString(key + "=" + quoteEnv(value) + "\n")
+	}
+	return out.Bytes()
+}
+
+// unsetEnv removes every assignment of key
+func unsetEnv(data []byte, key string) ([]byte, bool) {
+	var out bytes.Buffer
+	removed := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if m := envLineRe.FindStringSubmatch(strings.TrimSuffix(line, "\n")); m != nil && m[2] == key {
+			removed = true
+			continue
+		}
+		out.WriteString(line)
+	}
+	return out.Bytes(), removed
+}
+
+func quoteEnv(value string) string {
+	if envBareRe.MatchString(value) {
+		return value
+	}
+	return `"` + envEscaping.Replace(value) + `"`
+}
+
+func unquoteEnv(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) >= 2 && raw[0] == '"' {
+		if end := closingQuote(raw); end > 0 {
+			return envUnescape.Replace(raw[1:end])
+		}
+	}
+	if len(raw) >= 2 && raw[0] == '\'' {
+		if end := strings.IndexByte(raw[1:], '\''); end >= 0 {
+			return raw[1 : end+1]
+		}
+	}
+	// unquoted values end at an inline comment
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(raw)
+}
+
+// closingQuote returns the index of the unescaped double quote closing raw
+func closingQuote(raw string) int {
+	for i := 1; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
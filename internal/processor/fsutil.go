@@ -11,15 +11,7 @@ import (
 )
 
 func WriteToFile(data []byte, file config.FileConfig) error {
-	path := file.Output
-	if path == "" {
-		// Default output filename if none specified, e.g. replace .age with .env
-		path = filepath.Base(file.Path)
-		fmt.Println(path)
-		if filepath.Ext(path) == ".age" {
-			path = path[:len(path)-4] + ".env"
-		}
-	}
+	path := file.OutputPath()
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return fmt.Errorf("failed to create directories for %s: %w", path, err)
 	}
@@ -30,6 +22,68 @@ func WriteToFile(data []byte, file config.FileConfig) error {
 	return nil
 }
 
+// WriteStreamToFile streams the output of write into the output of the file. The content
+// goes to a temporary file first so a failed write never leaves a partial output behind.
+func WriteStreamToFile(file config.FileConfig, write func(io.Writer) error) error {
+	return writeOutput(file, write, nil)
+}
+
+// writeOutput is WriteStreamToFile running replace, unless nil, once the content is complete
+// and right before it replaces the output
+func writeOutput(file config.FileConfig, write func(io.Writer) error, replace func() error) error {
+	path := file.OutputPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %w", path, err)
+	}
+	if err := replaceFileAtomic(path, 0600, write, replace); err != nil {
+		return fmt.Errorf("failed to write decrypted file to %s: %w", path, err)
+	}
+	return nil
+}
+
+// samePath reports whether both paths name the same location, relative paths are taken
+// relative to the working directory
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// writeFileAtomic writes to a temporary file next to path with the given permissions and renames it on success
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	return replaceFileAtomic(path, perm, write, nil)
+}
+
+// replaceFileAtomic is writeFileAtomic running replace, unless nil, right before the rename
+func replaceFileAtomic(path string, perm os.FileMode, write func(io.Writer) error, replace func() error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if replace != nil {
+		if err := replace(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // IOWrapper is a generic wrapper for reading/writing files/STDIN/STDOUT
 func IOWrapper[T any](input, output string, additional T, process func([]byte, T) ([]byte, error)) error {
 	var inputBytes []byte
@@ -63,3 +117,24 @@ func IOWrapper[T any](input, output string, additional T, process func([]byte, T
 	}
 	return nil
 }
+
+// StreamWrapper is the streaming counterpart of IOWrapper, it connects files/STDIN/STDOUT
+// to process without reading the input into memory
+func StreamWrapper(input, output string, process func(dst io.Writer, src io.Reader) error) error {
+	var src io.Reader = os.Stdin
+	if input != constants.StandardInput {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	if output == constants.StandardOutput {
+		return process(os.Stdout, src)
+	}
+	return writeFileAtomic(output, 0600, func(dst io.Writer) error {
+		return process(dst, src)
+	})
+}
@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aottr/nox/internal/cache"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/git"
+	"github.com/aottr/nox/internal/logging"
+	"github.com/aottr/nox/internal/state"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// History writes the commits that changed each file of the context's app, or only path if set
+func History(ctx *config.RuntimeContext, path string, w io.Writer) error {
+	app := ctx.Config.Apps[ctx.App]
+	paths := []string{path}
+	if path == "" {
+		paths = nil
+		for _, file := range app.Files {
+			paths = append(paths, file.Path)
+		}
+	} else if _, ok := app.FindFile(path); !ok {
+		return fmt.Errorf("app %s has no file %s", ctx.App, path)
+	}
+
+	repo, err := cache.GlobalCache.GetOrFetch(repoKeyForApp(ctx.Config, ctx.App))
+	if err != nil {
+		return fmt.Errorf("failed to fetch repo for app %s: %w", ctx.App, err)
+	}
+	if err := repo.FetchHistory(); err != nil {
+		return err
+	}
+	pin, pinned := ctx.State.PinnedCommit(ctx.App)
+	if pinned {
+		fmt.Fprintf(w, "app %s is pinned to %s\n\n", ctx.App, shortHash(pin))
+	}
+
+	for i, p := range paths {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		commits, err := repo.FileHistory(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, p)
+		for _, c := range commits {
+			marker := ""
+			if pinned && c.Hash.String() == pin {
+				marker = "  (pinned)"
+			}
+			fmt.Fprintf(w, "  %s  %s  %s <%s>  %s%s\n",
+				shortHash(c.Hash.String()),
+				c.Author.When.Format("2006-01-02 15:04"),
+				c.Author.Name, c.Author.Email,
+				firstLine(c.Message), marker)
+		}
+	}
+	return nil
+}
+
+// Rollback pins the context's app to the commit rev resolves to and syncs it from that commit
+func Rollback(ctx *config.RuntimeContext, rev string) error {
+	repo, err := cache.GlobalCache.GetOrFetch(repoKeyForApp(ctx.Config, ctx.App))
+	if err != nil {
+		return fmt.Errorf("failed to fetch repo for app %s: %w", ctx.App, err)
+	}
+	commit, err := commitAt(repo, rev)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	for _, file := range ctx.Config.Apps[ctx.App].Files {
+		if !git.FileExistsInTree(tree, file.Path) {
+			return fmt.Errorf("%s of app %s does not exist at %s", file.Path, ctx.App, shortHash(commit.Hash.String()))
+		}
+	}
+
+	// the pin only selects the tree of this sync until it succeeded, every file is
+	// written again so a pinned revision that does not decrypt is never kept
+	pin := commit.Hash.String()
+	ctx.State.Pin(ctx.App, pin)
+	ctx.Force = true
+	if err := SyncApp(ctx); err != nil {
+		ctx.State.Release(ctx.App)
+		return fmt.Errorf("app %s not rolled back: %w", ctx.App, err)
+	}
+	if err := state.Update(func(s *state.State) { s.Pin(ctx.App, pin) }); err != nil {
+		return fmt.Errorf("failed to save the pin of app %s: %w", ctx.App, err)
+	}
+	logging.Get().Info(fmt.Sprintf("app %s rolled back and pinned to %s, release it with nox rollback %s --release",
+		ctx.App, shortHash(commit.Hash.String()), ctx.App))
+	return nil
+}
+
+// Release removes the pin of the context's app and syncs it from the branch head again
+func Release(ctx *config.RuntimeContext) error {
+	if !ctx.State.Release(ctx.App) {
+		return fmt.Errorf("app %s is not pinned", ctx.App)
+	}
+	if err := state.Update(func(s *state.State) { s.Release(ctx.App) }); err != nil {
+		return fmt.Errorf("failed to release app %s: %w", ctx.App, err)
+	}
+	if err := SyncApp(ctx); err != nil {
+		return err
+	}
+	logging.Get().Info(fmt.Sprintf("app %s released", ctx.App))
+	return nil
+}
+
+// commitAt resolves rev, fetching the history of the shallow clone if needed
+func commitAt(repo *git.ClonedRepo, rev string) (*object.Commit, error) {
+	if commit, err := repo.CommitAt(rev); err == nil {
+		return commit, nil
+	}
+	if err := repo.FetchHistory(); err != nil {
+		return nil, err
+	}
+	return repo.CommitAt(rev)
+}
+
+// treeAt returns the tree of the commit rev resolves to
+func treeAt(repo *git.ClonedRepo, rev string) (*object.Tree, error) {
+	commit, err := commitAt(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
+func firstLine(message string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	return line
+}
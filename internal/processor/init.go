@@ -0,0 +1,275 @@
+package processor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/constants"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/git"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// initOutputDir holds the outputs of the apps created for discovered files
+const initOutputDir = "secrets"
+
+// initDefaultApp holds discovered files at the root of the repository that give no app name
+const initDefaultApp = "default"
+
+type InitOptions struct {
+	ConfigPath string
+	Repo       string
+	Branch     string
+	// Identity is the age identity file, generated if it does not exist
+	Identity string
+	// Discover creates apps for the .age files of the repository
+	Discover bool
+	// Interactive asks for every setting, the options are the defaults
+	Interactive bool
+	In          io.Reader
+	Out         io.Writer
+}
+
+// Init writes a new config that passes validation: it checks that the repository is reachable,
+// generates or loads the identity and optionally creates apps for the encrypted files of the repository
+func Init(opts InitOptions) error {
+	if _, err := os.Stat(opts.ConfigPath); err == nil {
+		return fmt.Errorf("config file %s already exists", opts.ConfigPath)
+	}
+	p := &prompter{in: bufio.NewReader(opts.In), out: opts.Out, interactive: opts.Interactive}
+
+	gitConf := config.GitConfig{Repo: opts.Repo, Branch: opts.Branch}
+	if gitConf.Branch == "" {
+		gitConf.Branch = "main"
+	}
+	var repo *git.ClonedRepo
+	for {
+		gitConf.Repo = p.ask("Repository URL", gitConf.Repo)
+		gitConf.Branch = p.ask("Branch", gitConf.Branch)
+		if !gitConf.IsValid() {
+			if !p.interactive {
+				return fmt.Errorf("a repository and branch are required")
+			}
+			continue
+		}
+		var err error
+		repo, err = git.CloneRepo(gitConf)
+		if err == nil {
+			break
+		}
+		err = fmt.Errorf("cannot reach branch %s of %s: %w", gitConf.Branch, gitConf.Repo, err)
+		if !p.interactive {
+			return err
+		}
+		fmt.Fprintf(p.out, "❌ %v\n", err)
+	}
+	fmt.Fprintf(p.out, "✅ Reached branch %s of %s\n", gitConf.Branch, gitConf.Repo)
+
+	identityPath, recipient, ids, err := initIdentity(p, opts.Identity)
+	if err != nil {
+		return err
+	}
+
+	cfg := config.Config{
+		IntervalString: "10m",
+		StatePath:      constants.DefaultStatePath,
+		GitConfig:      gitConf,
+		Age: config.AgeConfig{
+			Identity:   configRelative(opts.ConfigPath, identityPath),
+			Recipients: []string{recipient},
+		},
+		Apps: make(map[string]config.AppConfig),
+	}
+
+	var found []string
+	err = repo.Tree.Files().ForEach(func(f *object.File) error {
+		if strings.HasSuffix(f.Name, ".age") {
+			found = append(found, f.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the files of the repository: %w", err)
+	}
+	if len(found) > 0 && p.confirm(fmt.Sprintf("Create apps for the %d encrypted files of the repository?", len(found)), opts.Discover) {
+		for _, name := range found {
+			file, err := discoverFile(repo.Tree, name, recipient, ids)
+			if err != nil {
+				fmt.Fprintf(p.out, "⚠️ skipped %s: %v\n", name, err)
+				continue
+			}
+			appName := discoveredApp(name)
+			app := cfg.Apps[appName]
+			app.Files = append(app.Files, file)
+			cfg.Apps[appName] = app
+			fmt.Fprintf(p.out, "✅ Added %s to app %s\n", name, appName)
+		}
+	}
+
+	if err := config.InitConfig(opts.ConfigPath, cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(p.out, "✅ Wrote %s\n", opts.ConfigPath)
+	return nil
+}
+
+// initIdentity loads the identity file or generates it if it does not exist, and returns
+// its path, its public key and the identities to check the discovered files with
+func initIdentity(p *prompter, path string) (string, string, []age.Identity, error) {
+	for {
+		path = p.ask("Age identity file", path)
+		if path == "" {
+			if !p.interactive {
+				return "", "", nil, fmt.Errorf("an identity file is required")
+			}
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			if !p.confirm(fmt.Sprintf("%s does not exist, generate a new identity?", path), true) {
+				path = ""
+				continue
+			}
+			priv, pub, err := crypto.GenerateIdentity(path)
+			if err != nil {
+				return "", "", nil, err
+			}
+			id, err := age.ParseX25519Identity(priv)
+			if err != nil {
+				return "", "", nil, err
+			}
+			fmt.Fprintf(p.out, "✅ Generated identity %s with public key %s\n", path, pub)
+			return path, pub, []age.Identity{id}, nil
+		}
+
+		infos, err := crypto.LoadIdentityInfos(path)
+		if err == nil {
+			for _, info := range infos {
+				if info.Recipient == "" {
+					continue
+				}
+				ids := make([]age.Identity, len(infos))
+				for i := range infos {
+					ids[i] = infos[i].Identity
+				}
+				fmt.Fprintf(p.out, "✅ Using identity %s with public key %s\n", path, info.Recipient)
+				return path, info.Recipient, ids, nil
+			}
+			err = fmt.Errorf("no public key can be derived, use an age or ssh key")
+		}
+		err = fmt.Errorf("cannot use identity %s: %w", path, err)
+		if !p.interactive {
+			return "", "", nil, err
+		}
+		fmt.Fprintf(p.out, "❌ %v\n", err)
+		path = ""
+	}
+}
+
+// discoverFile maps an encrypted file of the repository to the config if the identity decrypts it.
+// Files encrypted to further recipients keep them when a recipients manifest lists them.
+func discoverFile(tree *object.Tree, name, recipient string, ids []age.Identity) (config.FileConfig, error) {
+	output := strings.TrimSuffix(name, ".age")
+	if path.Base(output) == "." || strings.HasSuffix(output, "/") {
+		// a file named .age keeps its name
+		output = name
+	}
+	file := config.FileConfig{
+		Path:   name,
+		Output: path.Join(initOutputDir, output),
+	}
+	if err := decryptTreeFile(tree, name, ids, io.Discard); err != nil {
+		return file, fmt.Errorf("the identity cannot decrypt it: %w", err)
+	}
+
+	content, err := git.GetFileContentFromTree(tree, name)
+	if err != nil {
+		return file, err
+	}
+	header, err := crypto.ParseHeader(content)
+	if err != nil {
+		return file, err
+	}
+	if manifestPath := crypto.ManifestPath(name); git.FileExistsInTree(tree, manifestPath) {
+		data, err := git.GetFileContentFromTree(tree, manifestPath)
+		if err != nil {
+			return file, err
+		}
+		if manifest := crypto.ParseRecipientsManifest(data); !slices.Equal(manifest, []string{recipient}) {
+			file.Recipients = manifest
+		}
+		return file, nil
+	}
+	if header.Recipients() != 1 {
+		return file, fmt.Errorf("encrypted to %d recipients without a recipients manifest, add it by hand", header.Recipients())
+	}
+	return file, nil
+}
+
+// discoveredApp names the app of a discovered file after its top-level directory, files at
+// the root of the repository get an app named after the file, like env for .env.age
+func discoveredApp(name string) string {
+	if dir, _, ok := strings.Cut(name, "/"); ok {
+		return dir
+	}
+	name = strings.TrimLeft(strings.TrimSuffix(name, ".age"), ".")
+	if name = strings.TrimSuffix(name, path.Ext(name)); name == "" {
+		return initDefaultApp
+	}
+	return name
+}
+
+// prompter asks for settings on the terminal, without interaction it returns the defaults
+type prompter struct {
+	in          *bufio.Reader
+	out         io.Writer
+	interactive bool
+}
+
+func (p *prompter) ask(question, def string) string {
+	if !p.interactive {
+		return def
+	}
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	if err != nil {
+		// the input is closed, the remaining settings keep their defaults
+		p.interactive = false
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def
+	}
+	return answer
+}
+
+func (p *prompter) confirm(question string, def bool) bool {
+	if !p.interactive {
+		return def
+	}
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	fmt.Fprintf(p.out, "%s [%s]: ", question, hint)
+	answer, err := p.in.ReadString('\n')
+	if err != nil {
+		p.interactive = false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	}
+	return def
+}
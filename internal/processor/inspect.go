@@ -0,0 +1,109 @@
+package processor
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aottr/nox/internal/crypto"
+)
+
+// AuditRecipients compares the header of an encrypted file, and its recipients manifest
+// if there is one, with the recipients the file is expected to be encrypted to.
+// It returns a description of every mismatch.
+func AuditRecipients(header *crypto.Header, manifest []string, expected []string) []string {
+	var problems []string
+
+	if n := header.Recipients(); n != len(expected) {
+		problems = append(problems, fmt.Sprintf("encrypted to %d recipients, expected %d", n, len(expected)))
+	}
+
+	tags := header.SSHTags()
+	expectedTags := make(map[string]string)
+	for _, r := range expected {
+		if !strings.HasPrefix(r, "ssh-") {
+			continue
+		}
+		tag, err := crypto.SSHKeyTag(r)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		expectedTags[tag] = r
+		if !slices.Contains(tags, tag) {
+			problems = append(problems, fmt.Sprintf("not encrypted to %s", shortKey(r)))
+		}
+	}
+	for _, tag := range tags {
+		if _, ok := expectedTags[tag]; !ok {
+			problems = append(problems, fmt.Sprintf("encrypted to unexpected ssh key with tag %s", tag))
+		}
+	}
+
+	if manifest != nil {
+		for _, r := range manifest {
+			if !slices.Contains(expected, r) {
+				problems = append(problems, fmt.Sprintf("encrypted to unexpected recipient %s", shortKey(r)))
+			}
+		}
+		for _, r := range expected {
+			if !slices.Contains(manifest, r) {
+				problems = append(problems, fmt.Sprintf("not encrypted to %s", shortKey(r)))
+			}
+		}
+		if len(manifest) != header.Recipients() {
+			problems = append(problems, "recipients manifest does not match the file header")
+		}
+	}
+	return slices.Compact(problems)
+}
+
+// PrintHeader prints the stanza counts of a header and names the SSH keys it is encrypted to
+func PrintHeader(header *crypto.Header, known []string) {
+	counts := header.Counts()
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	fmt.Printf("recipient stanzas: %d\n", header.Recipients())
+	for _, t := range types {
+		fmt.Printf("  %-12s %d\n", t, counts[t])
+	}
+
+	knownTags := make(map[string]string)
+	for _, r := range known {
+		if tag, err := crypto.SSHKeyTag(r); err == nil {
+			knownTags[tag] = r
+		}
+	}
+	for _, tag := range header.SSHTags() {
+		if r, ok := knownTags[tag]; ok {
+			fmt.Printf("  ssh key %s: %s\n", tag, shortKey(r))
+		} else {
+			fmt.Printf("  ssh key %s: not configured\n", tag)
+		}
+	}
+}
+
+// shortKey abbreviates a recipient for display, keeping an SSH key comment if present
+func shortKey(r string) string {
+	fields := strings.Fields(r)
+	if len(fields) >= 2 && strings.HasPrefix(fields[0], "ssh-") {
+		s := fields[0] + " " + abbreviate(fields[1])
+		if len(fields) > 2 {
+			s += " " + strings.Join(fields[2:], " ")
+		}
+		return s
+	}
+	return abbreviate(r)
+}
+
+func abbreviate(s string) string {
+	if len(s) <= 20 {
+		return s
+	}
+	return s[:12] + "..." + s[len(s)-6:]
+}
@@ -0,0 +1,297 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/crypto"
+	"github.com/aottr/nox/internal/git"
+	"github.com/aottr/nox/internal/logging"
+)
+
+type RekeyOptions struct {
+	// RepoDir is the root of a local working copy of the top-level repository
+	RepoDir string
+	// RepoDirs maps the repositories of apps with a git configuration of their own to working copies
+	RepoDirs map[string]string
+	// Dir, relative to RepoDir, is walked for .age files instead of using the files of the config
+	Dir     string
+	DryRun  bool
+	Commit  bool
+	Message string
+}
+
+// rekeyGroup holds the files of one repository and branch, they are rewritten in one working copy
+type rekeyGroup struct {
+	git   config.GitConfig
+	dir   string
+	paths []string
+}
+
+// Rekey decrypts every secret with the identities of the context and encrypts it again
+// to the recipients configured for the file. Files already encrypted to their recipients
+// are left as they are. It returns the repository relative paths that were, or in
+// dry-run mode would be, rewritten.
+func Rekey(ctx *config.RuntimeContext, opts RekeyOptions) ([]string, error) {
+	log := logging.Get()
+
+	groups, err := rekeyGroups(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	fileRecipients, err := configuredRecipients(ctx.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	var errs []error
+	for _, group := range groups {
+		// working copies are expected on the branch of their apps, plain directories are not checked
+		if branch, err := git.CurrentBranch(group.dir); err == nil && group.git.Branch != "" && branch != group.git.Branch {
+			errs = append(errs, fmt.Errorf("working copy %s is on branch %q, check out %s to rekey %d files of %s",
+				group.dir, branch, group.git.Branch, len(group.paths), group.git.Repo))
+			continue
+		}
+
+		var groupChanged []string
+		rekeyed := 0
+		for _, path := range group.paths {
+			keys, ok := fileRecipients[group.git][path]
+			if !ok {
+				if keys, err = ctx.Config.ResolveRecipients(ctx.Config.Age.Recipients); err != nil {
+					return nil, err
+				}
+			}
+			if len(keys) == 0 {
+				errs = append(errs, fmt.Errorf("%s: no recipients configured", path))
+				continue
+			}
+			recipients, err := crypto.StringsToRecipients(keys)
+			if err != nil {
+				return nil, err
+			}
+
+			file := filepath.Join(group.dir, path)
+			reasons, err := recipientChanges(file, crypto.ManifestPath(file), keys)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				continue
+			}
+			if len(reasons) == 0 {
+				log.Debug(fmt.Sprintf("%s is encrypted to its recipients", path))
+				continue
+			}
+			if err := rekeyFile(file, ctx.Identities, recipients, opts.DryRun); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				continue
+			}
+			if opts.DryRun {
+				fmt.Printf("would re-encrypt %s: %s\n", path, strings.Join(reasons, ", "))
+				changed = append(changed, path)
+				continue
+			}
+			// the recipients manifest lets the next run compare X25519 recipients
+			if err := crypto.WriteRecipientsManifest(file, keys); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				continue
+			}
+			groupChanged = append(groupChanged, crypto.ManifestPath(path))
+			fmt.Printf("re-encrypted %s\n", path)
+			groupChanged = append(groupChanged, path)
+			rekeyed++
+		}
+		changed = append(changed, groupChanged...)
+
+		if opts.Commit && !opts.DryRun && len(groupChanged) > 0 {
+			message := opts.Message
+			if message == "" {
+				message = fmt.Sprintf("Rekey %d secrets", rekeyed)
+			}
+			hash, err := git.CommitFiles(group.dir, groupChanged, message)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				log.Info(fmt.Sprintf("committed %s in %s", hash, group.dir))
+			}
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// recipientChanges compares the recipients a file is encrypted to with the configured ones and
+// describes every difference. X25519 recipients cannot be read from the header, without a
+// recipients manifest such files are reported as changed.
+func recipientChanges(path, manifestPath string, keys []string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header, err := crypto.ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	var manifest []string
+	if data, err := os.ReadFile(manifestPath); err == nil {
+		manifest = crypto.ParseRecipientsManifest(data)
+	}
+	if problems := AuditRecipients(header, manifest, keys); len(problems) > 0 {
+		return problems, nil
+	}
+	if manifest == nil {
+		sshOnly := !slices.ContainsFunc(keys, func(k string) bool { return !strings.HasPrefix(k, "ssh-") })
+		if !sshOnly || header.Counts()["X25519"] > 0 {
+			return []string{"recipients cannot be compared without a recipients manifest"}, nil
+		}
+	}
+	return nil, nil
+}
+
+// configuredRecipients maps every configured file path of a repository and branch to its
+// recipients. Files shared by several apps are encrypted to the union of their recipients.
+func configuredRecipients(cfg *config.Config) (map[config.GitConfig]map[string][]string, error) {
+	result := make(map[config.GitConfig]map[string][]string)
+	for appName, app := range cfg.Apps {
+		gitConf := app.GitConfig
+		if !gitConf.IsValid() {
+			gitConf = cfg.GitConfig
+		}
+		if result[gitConf] == nil {
+			result[gitConf] = make(map[string][]string)
+		}
+		files := result[gitConf]
+		for i := range app.Files {
+			keys, err := cfg.RecipientsFor(appName, &app.Files[i])
+			if err != nil {
+				return nil, err
+			}
+			path := app.Files[i].Path
+			for _, key := range keys {
+				if !slices.Contains(files[path], key) {
+					files[path] = append(files[path], key)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// rekeyGroups collects the unique repository relative paths to re-encrypt, grouped by the
+// repository and branch of their apps. Files of repositories without a working copy are skipped.
+func rekeyGroups(ctx *config.RuntimeContext, opts RekeyOptions) ([]*rekeyGroup, error) {
+	cfg := ctx.Config
+	// RepoDir is the working copy of the top-level repository, without one of the repository all apps share
+	defaultRepo := cfg.GitConfig.Repo
+	if defaultRepo == "" {
+		repos := make(map[string]bool)
+		for _, appName := range selectedApps(ctx) {
+			repos[cfg.Apps[appName].GitConfig.Repo] = true
+		}
+		if len(repos) == 1 {
+			for repo := range repos {
+				defaultRepo = repo
+			}
+		}
+	}
+	workingCopy := func(gitConf config.GitConfig) string {
+		if dir, ok := opts.RepoDirs[gitConf.Repo]; ok {
+			return dir
+		}
+		if gitConf.Repo == defaultRepo {
+			return opts.RepoDir
+		}
+		return ""
+	}
+
+	if opts.Dir != "" {
+		var paths []string
+		root := filepath.Join(opts.RepoDir, opts.Dir)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) != ".age" {
+				return nil
+			}
+			rel, err := filepath.Rel(opts.RepoDir, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+			return nil
+		})
+		return []*rekeyGroup{{git: cfg.GitConfig, dir: opts.RepoDir, paths: paths}}, err
+	}
+
+	var groups []*rekeyGroup
+	byGit := make(map[config.GitConfig]*rekeyGroup)
+	for _, appName := range selectedApps(ctx) {
+		app := cfg.Apps[appName]
+		gitConf := app.GitConfig
+		if !gitConf.IsValid() {
+			gitConf = cfg.GitConfig
+		}
+		dir := workingCopy(gitConf)
+		if dir == "" {
+			logging.Get().Warn(fmt.Sprintf("skipping app %s: no working copy of %s given, add --repo %s=<path>", appName, gitConf.Repo, gitConf.Repo))
+			continue
+		}
+		group, ok := byGit[gitConf]
+		if !ok {
+			group = &rekeyGroup{git: gitConf, dir: dir}
+			byGit[gitConf] = group
+			groups = append(groups, group)
+		}
+		for _, file := range app.Files {
+			if slices.Contains(group.paths, file.Path) {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, file.Path)); err != nil {
+				logging.Get().Warn(fmt.Sprintf("skipping %s of app %s: not found in %s", file.Path, appName, dir))
+				continue
+			}
+			group.paths = append(group.paths, file.Path)
+		}
+	}
+	for _, group := range groups {
+		sort.Strings(group.paths)
+	}
+	return groups, nil
+}
+
+func rekeyFile(path string, identities []age.Identity, recipients []age.Recipient, dryRun bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := crypto.ReencryptAuto(data, identities, recipients)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	return writeFileAtomic(path, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aottr/nox/internal/cache"
+	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/git"
+	"github.com/aottr/nox/internal/logging"
+)
+
+const maxWaitBackoff = 15 * time.Second
+
+// WaitForRepos blocks until every repository used by the selected apps could be
+// fetched or the timeout expires. Authentication errors are not retried.
+func WaitForRepos(ctx *config.RuntimeContext, timeout time.Duration) error {
+	log := logging.Get()
+	deadline := time.Now().Add(timeout)
+
+	for _, appName := range selectedApps(ctx) {
+		key := repoKeyForApp(ctx.Config, appName)
+		backoff := time.Second
+		for {
+			_, err := cache.GlobalCache.GetOrFetch(key)
+			if err == nil {
+				break
+			}
+			if git.IsAuthError(err) {
+				return err
+			}
+			// the last attempt is made at the deadline, a backoff past it is cut short
+			wait := min(backoff, time.Until(deadline))
+			if wait <= 0 {
+				return fmt.Errorf("repository %s not reachable after %s: %w", key.Repo, timeout, err)
+			}
+			log.Info(fmt.Sprintf("waiting for repository %s (retrying in %s)", key.Repo, wait.Round(time.Millisecond)), "error", err.Error())
+			time.Sleep(wait)
+			backoff = min(backoff*2, maxWaitBackoff)
+		}
+	}
+	return nil
+}
+
+// RunOnce syncs the selected app, or all apps, a single time and records every
+// result in the returned summary instead of stopping at the first failure.
+func RunOnce(ctx *config.RuntimeContext) *Summary {
+	summary := NewSummary()
+	for _, appName := range selectedApps(ctx) {
+		ctx.App = appName
+		logging.Get().Debug(fmt.Sprintf("Processing app: %s", appName))
+		// failures are recorded in the summary, keep going with the next app
+		_ = syncApp(ctx, summary)
+	}
+	summary.Finish()
+	return summary
+}
+
+// ConfigFailure builds a summary for a run that could not start due to an invalid configuration
+func ConfigFailure(err error) *Summary {
+	summary := NewSummary()
+	summary.fail("", "", FailureConfig, err)
+	summary.Finish()
+	return summary
+}
+
+// WaitFailure builds a summary for a run whose repositories never became reachable
+func WaitFailure(err error) *Summary {
+	kind := FailureFetch
+	if git.IsAuthError(err) {
+		kind = FailureAuth
+	}
+	summary := NewSummary()
+	summary.fail("", "", kind, err)
+	summary.Finish()
+	return summary
+}
+
+// selectedApps returns the app of the context or all configured apps in a stable order
+func selectedApps(ctx *config.RuntimeContext) []string {
+	if ctx.App != "" {
+		return []string{ctx.App}
+	}
+	apps := make([]string, 0, len(ctx.Config.Apps))
+	for name := range ctx.Config.Apps {
+		apps = append(apps, name)
+	}
+	sort.Strings(apps)
+	return apps
+}
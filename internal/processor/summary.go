@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/aottr/nox/internal/constants"
+)
+
+// FailureKind categorizes why a file or app could not be synced
+type FailureKind string
+
+const (
+	FailureConfig  FailureKind = "config"
+	FailureAuth    FailureKind = "auth"
+	FailureFetch   FailureKind = "fetch"
+	FailureDecrypt FailureKind = "decrypt"
+	FailureWrite   FailureKind = "write"
+)
+
+// failureOrder ranks failure kinds from the earliest to the latest stage of a sync
+var failureOrder = []FailureKind{FailureConfig, FailureAuth, FailureFetch, FailureDecrypt, FailureWrite}
+
+var failureExitCodes = map[FailureKind]int{
+	FailureConfig:  constants.ExitConfigError,
+	FailureAuth:    constants.ExitAuthError,
+	FailureFetch:   constants.ExitFetchError,
+	FailureDecrypt: constants.ExitDecryptError,
+	FailureWrite:   constants.ExitWriteError,
+}
+
+const (
+	StatusWritten   = "written"
+	StatusUnchanged = "unchanged"
+	StatusFailed    = "failed"
+)
+
+// FileResult is the outcome of syncing a single file
+type FileResult struct {
+	App    string      `json:"app,omitempty"`
+	Path   string      `json:"path,omitempty"`
+	Output string      `json:"output,omitempty"`
+	Status string      `json:"status"`
+	Kind   FailureKind `json:"kind,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Summary collects the results of a sync run
+type Summary struct {
+	StartedAt time.Time    `json:"startedAt"`
+	Duration  string       `json:"duration"`
+	Written   int          `json:"written"`
+	Unchanged int          `json:"unchanged"`
+	Failed    int          `json:"failed"`
+	ExitCode  int          `json:"exitCode"`
+	Files     []FileResult `json:"files"`
+}
+
+func NewSummary() *Summary {
+	return &Summary{StartedAt: time.Now(), Files: []FileResult{}}
+}
+
+// record adds a result to the summary, it is a no-op on a nil summary
+func (s *Summary) record(res FileResult) {
+	if s == nil {
+		return
+	}
+	switch res.Status {
+	case StatusWritten:
+		s.Written++
+	case StatusUnchanged:
+		s.Unchanged++
+	case StatusFailed:
+		s.Failed++
+	}
+	s.Files = append(s.Files, res)
+}
+
+func (s *Summary) fail(app, path string, kind FailureKind, err error) {
+	s.record(FileResult{App: app, Path: path, Status: StatusFailed, Kind: kind, Error: err.Error()})
+}
+
+// Finish sets the duration and derives the exit code from the recorded results.
+// Any success next to a failure is reported as partial success, otherwise the
+// earliest failing stage determines the exit code.
+func (s *Summary) Finish() {
+	s.Duration = time.Since(s.StartedAt).Round(time.Millisecond).String()
+	if s.Failed == 0 {
+		s.ExitCode = constants.ExitOK
+		return
+	}
+	if s.Written+s.Unchanged > 0 {
+		s.ExitCode = constants.ExitPartial
+		return
+	}
+	s.ExitCode = constants.ExitFailure
+	for _, kind := range failureOrder {
+		for _, f := range s.Files {
+			if f.Kind == kind {
+				s.ExitCode = failureExitCodes[kind]
+				return
+			}
+		}
+	}
+}
+
+// Write prints the summary as JSON to the given path or STDOUT
+func (s *Summary) Write(output string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if output == constants.StandardOutput {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(output, data, 0644)
+}
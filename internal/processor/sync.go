@@ -1,8 +1,13 @@
 package processor
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+
+	"filippo.io/age"
 
 	"github.com/aottr/nox/internal/cache"
 	"github.com/aottr/nox/internal/config"
@@ -10,9 +15,23 @@ import (
 	"github.com/aottr/nox/internal/git"
 	"github.com/aottr/nox/internal/logging"
 	"github.com/aottr/nox/internal/state"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func SyncApp(ctx *config.RuntimeContext) error {
+	return syncApp(ctx, nil)
+}
+
+// repoKeyForApp returns the repository of the app, falling back to the global git config
+func repoKeyForApp(cfg *config.Config, appName string) cache.RepoKey {
+	gitConf := cfg.Apps[appName].GitConfig
+	if !gitConf.IsValid() {
+		gitConf = cfg.GitConfig
+	}
+	return cache.RepoKey{Repo: gitConf.Repo, Branch: gitConf.Branch}
+}
+
+func syncApp(ctx *config.RuntimeContext, summary *Summary) error {
 
 	log := logging.Get()
 	var err error
@@ -24,73 +43,167 @@ func SyncApp(ctx *config.RuntimeContext) error {
 
 	// retrieve app config and repository
 	app := cfg.Apps[appName]
-	gitConf := app.GitConfig
-	if !gitConf.IsValid() {
-		gitConf = cfg.GitConfig
-	}
-
-	key := cache.RepoKey{Repo: gitConf.Repo, Branch: gitConf.Branch}
-	repo, err := cache.GlobalCache.GetOrFetch(key)
+	repo, err := cache.GlobalCache.GetOrFetch(repoKeyForApp(cfg, appName))
 	if err != nil {
+		kind := FailureFetch
+		if git.IsAuthError(err) {
+			kind = FailureAuth
+		}
+		summary.fail(appName, "", kind, err)
 		return fmt.Errorf("failed to fetch repo for app %s: %w", appName, err)
 	}
 
-	// iterate over files and decrypt
+	// a rolled back app is synced from its pinned commit instead of the branch head
+	tree := repo.Tree
+	if pin, ok := st.PinnedCommit(appName); ok {
+		if tree, err = treeAt(repo, pin); err != nil {
+			summary.fail(appName, "", FailureFetch, err)
+			return fmt.Errorf("failed to get pinned commit of app %s: %w", appName, err)
+		}
+		log.Debug(fmt.Sprintf("app %s is pinned to %s", appName, shortHash(pin)))
+	}
+
+	// iterate over files and decrypt, a failed file does not stop the remaining ones
+	var failed []string
+	hashes := make(map[string]string)
 	for _, file := range app.Files {
-		content, err := git.GetFileContentFromTree(repo.Tree, file.Path)
+		hash, err := hashTreeFile(tree, file.Path)
 		if err != nil {
-			return fmt.Errorf("failed to get file %s: %w", file, err)
+			log.Error(fmt.Sprintf("failed to get file %s", file.Path), "error", err.Error())
+			summary.fail(appName, file.Path, FailureFetch, err)
+			failed = append(failed, file.Path)
+			continue
 		}
 
-		hash := state.HashContent(content)
 		cacheKey := state.GenerateKey(appName, file.Path)
 
 		// skip if file is up to date and force is not set
 		if !ctx.Force && !ctx.DryRun {
 			if prevHash, ok := st.Data[cacheKey]; ok && prevHash == hash {
 				log.Debug(fmt.Sprintf("file %s is up to date", file.Path))
+				summary.record(FileResult{App: appName, Path: file.Path, Output: file.Output, Status: StatusUnchanged})
 				continue
 			}
 		}
 
-		// decrypt file
-		plaintext, err := crypto.DecryptBytes(content, identities)
-		if err != nil {
-			log.Warn("failed to decrypt file %s: %v", file.Path, err)
-			continue
-		}
-
 		// skip writing file if dry run is set
 		if ctx.DryRun {
 			log.Debug(fmt.Sprintf("dry run, not writing file %s", file.Output))
-			os.Stdout.Write(plaintext)
+			if err := decryptTreeFile(tree, file.Path, identities, os.Stdout); err != nil {
+				log.Warn(fmt.Sprintf("failed to decrypt file %s", file.Path), "error", err.Error())
+				summary.fail(appName, file.Path, FailureDecrypt, err)
+				failed = append(failed, file.Path)
+			}
 			continue
 		}
-		if err := WriteToFile(plaintext, file); err != nil {
-			log.Error("failed to write file %s: %v", file.Output, err)
+
+		// stream the decrypted blob into the output file, the current output is only backed
+		// up once the blob decrypted so a broken commit does not rotate out older backups
+		out := &countingWriter{}
+		var decryptErr, backupErr error
+		err = writeOutput(file, func(w io.Writer) error {
+			out.w = w
+			decryptErr = decryptTreeFile(tree, file.Path, identities, out)
+			return decryptErr
+		}, func() error {
+			if backupErr = backupOutput(ctx, appName, file); backupErr == nil {
+				backupErr = pruneBackups(ctx, appName, file)
+			}
+			return backupErr
+		})
+		if backupErr != nil {
+			log.Error(fmt.Sprintf("failed to back up %s", file.OutputPath()), "error", backupErr.Error())
+			summary.fail(appName, file.Path, FailureWrite, backupErr)
+			failed = append(failed, file.Path)
+			continue
+		}
+		if decryptErr != nil && out.err == nil {
+			log.Warn(fmt.Sprintf("failed to decrypt file %s", file.Path), "error", decryptErr.Error())
+			summary.fail(appName, file.Path, FailureDecrypt, decryptErr)
+			failed = append(failed, file.Path)
+			continue
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("failed to write file %s", file.Output), "error", err.Error())
+			summary.fail(appName, file.Path, FailureWrite, err)
+			failed = append(failed, file.Path)
 			continue
 		}
 
-		log.Debug(fmt.Sprintf("decrypted %s for app %s (size: %d bytes)", file, appName, len(plaintext)))
+		log.Debug(fmt.Sprintf("decrypted %s for app %s (size: %d bytes)", file.Path, appName, out.n))
+		summary.record(FileResult{App: appName, Path: file.Path, Output: file.Output, Status: StatusWritten})
 
 		// update state
 		st.Data[cacheKey] = hash
 		st.Touch()
+		hashes[cacheKey] = hash
 	}
 
-	if err := state.Save(st); err != nil {
+	// merge into the state file, pins of nox rollback are only written by rollback itself
+	err = state.Update(func(s *state.State) {
+		for key, hash := range hashes {
+			s.Data[key] = hash
+		}
+		if len(hashes) > 0 {
+			s.Touch()
+		}
+	})
+	if err != nil {
+		summary.fail(appName, "", FailureWrite, err)
 		return fmt.Errorf("failed to save state: %w", err)
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to sync files %s of app %s", strings.Join(failed, ", "), appName)
+	}
 	return nil
 }
 
+// hashTreeFile returns the SHA256 hash of a file in the tree without loading it into memory
+func hashTreeFile(tree *object.Tree, path string) (string, error) {
+	r, err := git.OpenFileFromTree(tree, path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return state.HashReader(r)
+}
+
+// decryptTreeFile streams a file of the tree through decryption into w
+func decryptTreeFile(tree *object.Tree, path string, identities []age.Identity, w io.Writer) error {
+	r, err := git.OpenFileFromTree(tree, path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return crypto.DecryptStreamAuto(w, r, identities)
+}
+
+// countingWriter counts the bytes written and remembers the first write error,
+// which tells write failures apart from decryption failures
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// SyncApps syncs every app, a failed app does not stop the remaining ones
 func SyncApps(ctx *config.RuntimeContext) error {
+	var errs []error
 	for appName := range ctx.Config.Apps {
 		ctx.App = appName
 		logging.Get().Debug(fmt.Sprintf("Processing app: %s", appName))
 		if err := SyncApp(ctx); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
@@ -1,21 +1,32 @@
 package processor
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/aottr/nox/internal/config"
+	"github.com/aottr/nox/internal/crypto"
 	"github.com/aottr/nox/internal/git"
 )
 
 func ValidateConfig(cfg *config.Config) error {
-	if cfg.Age.Identity == "" {
-		return fmt.Errorf("age key path is required")
+	if len(cfg.IdentitySources()) == 0 {
+		return fmt.Errorf("age identity is required")
+	}
+
+	if cfg.Environment != "" {
+		fmt.Printf("✅ Using environment %s\n", cfg.Environment)
 	}
 
 	if cfg.StatePath == "" {
 		fmt.Printf("state path is not set, defaulting to default.\n")
 	}
 
+	if err := validateRecipients(cfg); err != nil {
+		return err
+	}
+
+	mismatches := 0
 	for appName, app := range cfg.Apps {
 		fmt.Printf("✅ Validating app %s\n", appName)
 
@@ -31,11 +42,85 @@ func ValidateConfig(cfg *config.Config) error {
 
 		for _, file := range app.Files {
 			if !git.FileExistsInTree(repo.Tree, file.Path) {
-				return fmt.Errorf("❌ file %s missing in app %s", file, appName)
+				return fmt.Errorf("❌ file %s missing in app %s", file.Path, appName)
+			}
+			fmt.Printf("✔️ Found file %s in repo\n", file.Path)
+
+			problems, err := auditTreeFile(cfg, appName, file, repo)
+			if errors.Is(err, config.ErrNoRecipients) {
+				// recipients are optional, there is nothing to compare the file with
+				fmt.Printf("➖ %s: no recipients configured, recipients not audited\n", file.Path)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("❌ failed to inspect file %s in app %s: %w", file.Path, appName, err)
+			}
+			for _, p := range problems {
+				fmt.Printf("⚠️ %s: %s\n", file.Path, p)
 			}
-			fmt.Printf("✔️ Found file %s in repo\n", file)
+			mismatches += len(problems)
 		}
 	}
+	if mismatches > 0 {
+		return fmt.Errorf("❌ found %d recipient mismatches", mismatches)
+	}
 	fmt.Println("all checks passed!")
 	return nil
 }
+
+// auditTreeFile compares the recipients of a file in the repository with its configured recipients
+func auditTreeFile(cfg *config.Config, appName string, file config.FileConfig, repo *git.ClonedRepo) ([]string, error) {
+	content, err := git.GetFileContentFromTree(repo.Tree, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	header, err := crypto.ParseHeader(content)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := cfg.RecipientsFor(appName, &file)
+	if err != nil {
+		return nil, err
+	}
+	var manifest []string
+	if manifestPath := crypto.ManifestPath(file.Path); git.FileExistsInTree(repo.Tree, manifestPath) {
+		data, err := git.GetFileContentFromTree(repo.Tree, manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		manifest = crypto.ParseRecipientsManifest(data)
+	}
+	return AuditRecipients(header, manifest, expected), nil
+}
+
+// validateRecipients checks that the recipients of every app and file resolve and parse
+func validateRecipients(cfg *config.Config) error {
+	for appName, app := range cfg.Apps {
+		lists := [][]string{app.Recipients}
+		for _, file := range app.Files {
+			lists = append(lists, file.Recipients)
+		}
+		for _, list := range lists {
+			keys, err := cfg.ResolveRecipients(list)
+			if err != nil {
+				return fmt.Errorf("❌ invalid recipients in app %s: %w", appName, err)
+			}
+			if len(keys) == 0 {
+				continue
+			}
+			if _, err := crypto.StringsToRecipients(keys); err != nil {
+				return fmt.Errorf("❌ invalid recipients in app %s: %w", appName, err)
+			}
+		}
+	}
+	for name, group := range cfg.Age.Groups {
+		if _, err := cfg.ResolveRecipients(group); err != nil {
+			return fmt.Errorf("❌ invalid recipient group %s: %w", name, err)
+		}
+	}
+	if _, err := cfg.ResolveRecipients(cfg.Age.Recipients); err != nil {
+		return fmt.Errorf("❌ invalid recipients: %w", err)
+	}
+	fmt.Println("✔️ Recipients are valid")
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 type State struct {
 	LastUpdated int64
 	Data        map[string]string
+	// Pins maps apps that were rolled back to the commit they are synced from
+	Pins map[string]string `json:"Pins,omitempty"`
 }
 
 var defaultPath = ".nox-state.json"
@@ -25,11 +27,58 @@ func (s *State) Touch() {
 	s.LastUpdated = time.Now().Unix()
 }
 
+// Pin syncs the app from the given commit until it is released
+func (s *State) Pin(app, commit string) {
+	if s.Pins == nil {
+		s.Pins = make(map[string]string)
+	}
+	s.Pins[app] = commit
+}
+
+// Release removes the pin of the app and reports whether it was pinned
+func (s *State) Release(app string) bool {
+	if _, ok := s.Pins[app]; !ok {
+		return false
+	}
+	delete(s.Pins, app)
+	return true
+}
+
+// PinnedCommit returns the commit the app is pinned to
+func (s *State) PinnedCommit(app string) (string, bool) {
+	commit, ok := s.Pins[app]
+	return commit, ok
+}
+
 // Load reads the state from the state file
 func Load() (*State, error) {
 	return loadFromFile(defaultPath)
 }
 
+// Reload replaces s with the state file, picking up pins and hashes written by other nox processes
+func (s *State) Reload() error {
+	fresh, err := Load()
+	if err != nil {
+		return err
+	}
+	*s = *fresh
+	return nil
+}
+
+// Update applies change to the state file as it is on disk and saves it, so a long running
+// process does not overwrite the pins and hashes other nox processes wrote meanwhile
+func Update(change func(*State)) error {
+	s, err := Load()
+	if err != nil {
+		return err
+	}
+	if s.Data == nil {
+		s.Data = make(map[string]string)
+	}
+	change(s)
+	return Save(s)
+}
+
 // Save writes the given State to the state file.
 // Overwrites any existing state file.
 func Save(state *State) error {
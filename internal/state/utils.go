@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 )
 
 // HashContent returns the SHA256 hash of the given data.
@@ -12,6 +13,15 @@ func HashContent(data []byte) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// HashReader returns the SHA256 hash of everything read from r.
+func HashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func GenerateKey(appName, file string) string {
 	return fmt.Sprintf("%s:%s", appName, file)
 }
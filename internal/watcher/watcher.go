@@ -10,24 +10,23 @@ import (
 	"github.com/aottr/nox/internal/processor"
 )
 
-func Start(cfg *config.Config) {
+func Start(ctx *config.RuntimeContext) {
 	log := logging.Get()
 	logging.SetLevel("debug")
+	cfg := ctx.Config
 	ticker := time.NewTicker(cfg.Interval)
 	defer ticker.Stop()
 
-	ctx, err := config.BuildRuntimeCtxFromConfig(cfg)
-	if err != nil {
-		log.Error("error building runtime context", "error", err.Error())
-		return
-	}
 	log.Info(fmt.Sprintf("Starting watcher (interval: %s)\n", cfg.Interval))
 
 	for {
 		if err := cache.GlobalCache.RefreshCache(); err != nil {
 			log.Error("error pre-fetching secrets", "error", err.Error())
 		}
-		if err := processor.SyncApps(ctx); err != nil {
+		// pick up pins written by nox rollback since the last sync
+		if err := ctx.State.Reload(); err != nil {
+			log.Error("error reloading state", "error", err.Error())
+		} else if err := processor.SyncApps(ctx); err != nil {
 			log.Error("error syncing secrets", "error", err.Error())
 		}
 		<-ticker.C